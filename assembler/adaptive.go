@@ -0,0 +1,115 @@
+package assembler
+
+import (
+	"github.com/hcg1314/stupid/assembler/basic"
+	"github.com/hcg1314/stupid/assembler/infra"
+	"sync/atomic"
+	"time"
+)
+
+const settledWindow = 10 // 计算稳定速度时取最后几次调整
+
+// adaptState 自适应速度的调整记录，由Assembler.lock保护
+type adaptState struct {
+	report basic.AdaptiveReport
+	recent []uint
+}
+
+// adapt 每个间隔根据出错比例、队列填充和上链时延调整速度，生成结束或者ctx取消后退出
+func (a *Assembler) adapt() {
+	ctl := a.adaptive
+	t := time.NewTicker(ctl.Interval)
+	defer t.Stop()
+
+	lastStat := basic.Snapshot()
+	commits := infra.GetCommitHistogram()
+	lastCount, lastSum := commits.Count(), commits.Sum()
+	paused := false
+	for {
+		select {
+		case <-t.C:
+		case <-a.done:
+			return
+		case <-a.ctx.Done():
+			return
+		}
+
+		stat := basic.Snapshot()
+		var s basic.RateSignal
+		var total, failed uint64
+		for i := range stat.Items {
+			total += stat.Items[i].Total - lastStat.Items[i].Total
+			failed += stat.Items[i].Fail - lastStat.Items[i].Fail + stat.Items[i].Retried - lastStat.Items[i].Retried
+		}
+		lastStat = stat
+		if total > 0 {
+			s.ErrorRate = float64(failed) / float64(total)
+		}
+		for _, c := range a.channels() {
+			if c.Cap > 0 {
+				if f := float64(c.Len) / float64(c.Cap); f > s.QueueFill {
+					s.QueueFill = f
+				}
+			}
+		}
+		commits = infra.GetCommitHistogram()
+		count, sum := commits.Count(), commits.Sum()
+		if count > lastCount {
+			s.Latency = (sum - lastSum) / float64(count-lastCount)
+		}
+		lastCount, lastSum = count, sum
+
+		current := a.GetSpeed()
+		if atomic.LoadInt32(&a.manual) != 0 {
+			if !paused {
+				paused = true
+				basic.Logf("adaptive rate paused, target rate set to %d tx/s manually", current)
+			}
+			continue
+		}
+		rate, reason := ctl.Next(current, s)
+		a.recordRate(current, rate)
+		if rate == current {
+			basic.Logf("adaptive rate holds at %d tx/s: %s", rate, reason)
+			continue
+		}
+		_ = a.SetSpeed(rate)
+		basic.Logf("adaptive rate %d -> %d tx/s: %s", current, rate, reason)
+	}
+}
+
+func (a *Assembler) recordRate(current, rate uint) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	r := &a.adaptState.report
+	switch {
+	case rate > current:
+		r.Increases++
+	case rate < current:
+		r.Decreases++
+	}
+	if rate < r.Lowest {
+		r.Lowest = rate
+	}
+	if a.adaptState.recent = append(a.adaptState.recent, rate); len(a.adaptState.recent) > settledWindow {
+		a.adaptState.recent = a.adaptState.recent[1:]
+	}
+}
+
+// adaptReport 调用时持有lock，没有启用自适应速度时返回nil
+func (a *Assembler) adaptReport() *basic.AdaptiveReport {
+	if a.adaptive == nil {
+		return nil
+	}
+	r := a.adaptState.report
+	r.Final = a.speed
+	r.Settled = float64(a.speed)
+	if n := len(a.adaptState.recent); n > 0 {
+		var sum uint
+		for _, v := range a.adaptState.recent {
+			sum += v
+		}
+		r.Settled = float64(sum) / float64(n)
+	}
+	return &r
+}
@@ -1,128 +1,427 @@
 package assembler
 
 import (
+	"context"
 	"fmt"
 	"github.com/hcg1314/stupid/assembler/basic"
 	"github.com/hcg1314/stupid/assembler/infra"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	speedSliceNum = 5
+	topErrorNum   = 20 // 输出和报告中最多列出的错误类别数
+)
+
+var (
+	queueDepth = basic.NewGaugeVec("stupid_queue_depth", "Number of transactions waiting in an internal queue.", "queue")
+	targetRate = basic.NewGaugeVec("stupid_target_rate", "Target number of transactions generated per second.")
+	lagGauge   = basic.NewGaugeVec("stupid_schedule_lag_seconds", "How far proposal creation is currently behind the rate schedule.")
+
+	scheduleLag = basic.NewHistogramVec("stupid_schedule_lag_duration_seconds", "Delay between intended send time and proposal creation.", basic.LatencyBuckets)
 )
 
 type Assembler struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
 	raw         chan *infra.Elements
 	config      *basic.Config
 	signer      *basic.Crypto
 	proposer    *infra.Dispatcher
 	broadcaster *infra.Dispatcher
 
+	speed      uint // 由lock保护，运行中可以修改
 	total      uint64
-	real       uint64
-	speedSlice []uint
-	stopped    bool
+	real       uint64 // 只在Start中递增，其它地方用atomic读
+	keyOffset  uint64 // 多个进程一起压测时各自使用不同的key
+	speedSlice []uint // 由lock保护
+	stopped    int32  // atomic
+	paused     int32  // atomic
 	done       chan struct{}
+
+	lock      sync.Mutex
+	startTime time.Time
+	peaks     map[string]int // 各队列的最大深度
+
+	lag int64 // atomic，最近一个交易落后于计划的时间，纳秒
+
+	resubmits   chan infra.Operation // 验证失效、需要重做的操作，没有配置重做时为nil
+	resubmitted uint64               // atomic，重做时新建的交易数
+
+	adaptive   *basic.RateController // 没有配置自适应速度时为nil
+	adaptState adaptState
+	manual     int32 // atomic，非0时速度被手动设置过，自适应速度不再调整
+
+	monitor    *basic.SelfMonitor
+	operations *basic.OperationsScraper // 没有配置运维端口时为nil
 }
 
-func CreateAssembler(speed uint, total uint64, path string) *Assembler {
-	config := basic.LoadConfig(path)
-	crypto := config.LoadCrypto()
+// CreateAssembler 连接所有节点，失败时返回带类别的错误(见basic.ErrorKind)，已建立的连接随之关闭。
+// ctx取消或者调用Close后所有goroutine退出并关闭各自的channel，连接也随之关闭
+func CreateAssembler(ctx context.Context, speed uint, total uint64, path string) (_ *Assembler, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+	}()
+
+	config, err := basic.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	crypto, err := config.LoadCrypto()
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := config.GetRPCTimeout()
+	if err != nil {
+		return nil, basic.WrapError(basic.ErrConfig, err, "rpc_timeout")
+	}
+
+	proposalRetry, err := config.GetRetryPolicy("proposal")
+	if err != nil {
+		return nil, &basic.Error{Kind: basic.ErrConfig, Err: err}
+	}
+	broadcastRetry, err := config.GetRetryPolicy("broadcast")
+	if err != nil {
+		return nil, &basic.Error{Kind: basic.ErrConfig, Err: err}
+	}
+
+	adaptive, err := config.Adaptive.Controller(speed)
+	if err != nil {
+		return nil, basic.WrapError(basic.ErrConfig, err, "adaptive_rate")
+	}
 
-	proposer := infra.CreateProposalDispatcher(config.NumOfConn, config.ClientPerConn, config.Peers, crypto)
+	proposer, err := infra.CreateProposalDispatcher(ctx, config.NumOfConn, config.ClientPerConn, config.Peers, crypto, timeout, proposalRetry, config.Routing.Proposal)
+	if err != nil {
+		return nil, err
+	}
+	broadcaster, err := infra.CreateBroadcastDispatcher(ctx, config.NumOfConn, config.Orderer, crypto, config.Reconnect, broadcastRetry, config.Routing.Broadcast)
+	if err != nil {
+		return nil, err
+	}
+	// 先从1个peer观察吧
+	if _, err = infra.CreateObserver(ctx, config.Peers[0], config.Channel, crypto, timeout); err != nil {
+		return nil, err
+	}
+
+	var interval time.Duration
+	targets := config.GetOperationsTargets()
+	if len(targets) > 0 {
+		if interval, err = config.GetOperationsInterval(); err != nil {
+			return nil, basic.WrapError(basic.ErrConfig, err, "operations_interval")
+		}
+	}
+	if err = basic.StartTracing(config.Tracing); err != nil {
+		return nil, basic.WrapError(basic.ErrConfig, err, "tracing")
+	}
 	go proposer.Start()
-	broadcaster := infra.CreateBroadcastDispatcher(config.NumOfConn, config.Orderer, crypto)
 	go broadcaster.Start()
-	infra.CreateObserver(config.Peers[0], config.Channel, crypto) // 先从1个peer观察吧
 
 	assembler := &Assembler{
+		ctx:         ctx,
+		cancel:      cancel,
 		raw:         make(chan *infra.Elements, 1000),
 		config:      config,
 		signer:      crypto,
 		proposer:    proposer,
 		broadcaster: broadcaster,
+		speed:       speed,
 		total:       total,
 		real:        0,
-		stopped:     false,
-		speedSlice:  make([]uint, speedSliceNum),
+		speedSlice:  splitSpeed(speed),
 		done:        make(chan struct{}),
+		peaks:       make(map[string]int),
+		adaptive:    adaptive,
+	}
+	if adaptive != nil {
+		assembler.adaptState.report = basic.AdaptiveReport{Mode: adaptive.Mode, Initial: speed, Lowest: speed}
+	}
+
+	if config.Resubmit.MaxAttempts > 1 {
+		assembler.resubmits = make(chan infra.Operation, 10000)
+		err = infra.GlobalObserver.SetResubmit(config.Resubmit.GetCodes(), config.Resubmit.MaxAttempts, assembler.onInvalid)
+		if err != nil {
+			return nil, basic.WrapError(basic.ErrConfig, err, "resubmit")
+		}
+	}
+
+	queueDepth.Set(func() float64 { return float64(len(assembler.raw)) }, "raw")
+	queueDepth.Set(func() float64 { return float64(assembler.proposer.GetWaitCount()) }, "proposer")
+	queueDepth.Set(func() float64 { return float64(assembler.broadcaster.GetWaitCount()) }, "broadcaster")
+	targetRate.Set(func() float64 { return float64(assembler.GetSpeed()) })
+	lagGauge.Set(func() float64 { return assembler.GetScheduleLag().Seconds() })
+	assembler.monitor = basic.StartSelfMonitor(ctx, time.Second, assembler.channels)
+
+	if len(targets) > 0 {
+		assembler.operations = basic.NewOperationsScraper(targets, config.OperationsMetrics, crypto.TLSCACerts)
+		assembler.operations.Start(ctx, interval)
+	}
+
+	err = basic.StartSinks(config.Sinks, func() (*basic.Sample, []basic.LatencyReport) {
+		return assembler.Sample(), assembler.GetLatency()
+	})
+	if err != nil {
+		return nil, basic.WrapError(basic.ErrConfig, err, "sinks")
 	}
 
+	return assembler, nil
+}
+
+// onInvalid 由Observer调用，交给Start重做。不能阻塞接收区块，
+// 已经Stop、ctx取消或者重做的队列满了时不接受
+func (a *Assembler) onInvalid(op infra.Operation) bool {
+	if a.IsStopped() || a.ctx.Err() != nil {
+		return false
+	}
+	// 先计入再放入队列，避免未确认数短暂降为0
+	atomic.AddUint64(&a.resubmitted, 1)
+	select {
+	case a.resubmits <- op:
+		return true
+	default:
+		atomic.AddUint64(&a.resubmitted, ^uint64(0))
+		return false
+	}
+}
+
+// Close 取消所有goroutine并关闭连接，不等待已发出的交易
+func (a *Assembler) Close() {
+	a.cancel()
+}
+
+// splitSpeed 把每秒的交易数分到每200ms的时间片中
+func splitSpeed(speed uint) []uint {
+	slice := make([]uint, speedSliceNum)
 	remainder := speed % speedSliceNum
 	base := speed / speedSliceNum
 	if base != 0 {
 		for i := 0; i < speedSliceNum; i++ {
-			assembler.speedSlice[i] = base
+			slice[i] = base
 		}
 	}
 	if remainder != 0 {
 		for i := 0; remainder > 0; i++ {
-			assembler.speedSlice[i] += 1
+			slice[i] += 1
 			remainder--
 		}
 	}
-
-	return assembler
+	return slice
 }
 
-func (a *Assembler) assemble(e *infra.Elements) *infra.Elements {
+func (a *Assembler) assemble(e *infra.Elements) error {
+	start := time.Now()
 	env, err := infra.CreateSignedTx(e.Proposal, a.signer, e.Response)
+	e.Trace.Span("assemble", "", 1, start, time.Now(), "", err)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	e.Envelope = env
-	return e
+	return nil
 }
 
-func (a *Assembler) sign(e *infra.Elements) *infra.Elements {
+func (a *Assembler) sign(e *infra.Elements) error {
+	start := time.Now()
 	sprop, err := infra.SignProposal(e.Proposal, a.signer)
+	e.Trace.Span("sign", "", 1, start, time.Now(), "", err)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	e.SignedProp = sprop
-	return e
+	return nil
 }
 
+// drop 丢弃处理失败的交易，计入失败和错误统计，不影响其它交易
+func (a *Assembler) drop(stage string, e *infra.Elements, err error) {
+	e.Trace.Finish("", err)
+	basic.RecordError(stage, "", err)
+	infra.GlobalObserver.AddFailed()
+}
+
+// Start 按目标速度生成交易，生成结束、Stop或者ctx取消后关闭raw，
+// 下游的goroutine处理完各自的输入后依次退出。配置了重做时，
+// 等所有操作都有了结果才关闭raw
 func (a *Assembler) Start() {
+	defer close(a.raw)
+	a.generate()
+	close(a.done)
+	a.forwardResubmits()
+}
 
+func (a *Assembler) generate() {
+	a.lock.Lock()
+	a.startTime = time.Now()
+	a.lock.Unlock()
+	go a.samplePeaks()
+	if a.adaptive != nil {
+		go a.adapt()
+	}
+
+	// 按目标速度均匀排布每个交易的计划发送时间，计算时延时以它为起点，
+	// 这样管道阻塞导致的等待也会计入，避免coordinated omission
+	intended := a.startTime
 	speedCtrl := time.NewTicker(200 * time.Millisecond)
+	defer speedCtrl.Stop()
 	speedIndex := 0
+	paused := false
 	for {
 		if speedIndex >= speedSliceNum {
 			speedIndex = 0
 		}
 
-		if a.real == a.total || a.stopped {
-			close(a.done)
-			break
+		if a.real == a.total || atomic.LoadInt32(&a.stopped) != 0 || a.ctx.Err() != nil {
+			return
 		}
 
 		select {
+		case <-a.ctx.Done():
+			return
+		case op := <-a.resubmits:
+			if !a.resubmitOp(op) {
+				return
+			}
 		case <-speedCtrl.C:
-			var i, num uint64 = 0, a.total-a.real
-			if num > uint64(a.speedSlice[speedIndex]) {
-				num = uint64(a.speedSlice[speedIndex])
+			if atomic.LoadInt32(&a.paused) != 0 {
+				paused = true
+				continue
+			}
+			// 暂停期间不算落后于计划
+			if paused {
+				paused = false
+				intended = time.Now()
+			}
+
+			a.lock.Lock()
+			slice, speed := a.speedSlice[speedIndex], a.speed
+			a.lock.Unlock()
+
+			var i, num uint64 = 0, a.total - a.real
+			if num > uint64(slice) {
+				num = uint64(slice)
 			}
 
 			for ; i < num; i++ {
-				prop := infra.CreateProposal(
-					a.signer,
-					a.config.Channel,
-					a.config.Chaincode,
-					"addFile",
-					fmt.Sprintf("%d", a.real),
-					fmt.Sprintf("%d", a.real),
-				)
-				a.real += 1
-				a.raw <- &infra.Elements{Proposal: prop}
+				start := time.Now()
+				lag := start.Sub(intended)
+				if lag < 0 {
+					lag = 0
+				}
+				atomic.StoreInt64(&a.lag, int64(lag))
+				scheduleLag.With().Observe(lag.Seconds())
+
+				key := fmt.Sprintf("%d", a.keyOffset+a.real)
+				prop, txid, err := infra.CreateProposal(a.signer, a.config.Channel, a.config.Chaincode, "addFile", key, key)
+				if err != nil {
+					// 还没有计入生成数，不用计入失败
+					basic.RecordError("create", "", err)
+					intended = intended.Add(time.Second / time.Duration(speed))
+					continue
+				}
+				trace := basic.NewTrace(txid, start)
+				trace.Span("create", "", 1, start, time.Now(), "", nil)
+				select {
+				case a.raw <- &infra.Elements{TxID: txid, Intended: intended, Start: start, Proposal: prop, Trace: trace,
+					Op: infra.Operation{Key: key, Attempt: 1, First: start}}:
+				case <-a.ctx.Done():
+					return
+				}
+				atomic.AddUint64(&a.real, 1)
+				intended = intended.Add(time.Second / time.Duration(speed))
 			}
 		}
 		speedIndex += 1
 	}
 }
 
+// resubmitOp 用新的交易重做一个验证失效的操作，不按目标速度排队，ctx取消时返回false。
+// Stop之后不再重做，计为放弃
+func (a *Assembler) resubmitOp(op infra.Operation) bool {
+	if a.IsStopped() {
+		atomic.AddUint64(&a.resubmitted, ^uint64(0))
+		infra.GlobalObserver.GiveUp()
+		return true
+	}
+	start := time.Now()
+	prop, txid, err := infra.CreateProposal(a.signer, a.config.Channel, a.config.Chaincode, "addFile", op.Key, op.Key)
+	if err != nil {
+		// 已经计入重做数，计为失败
+		basic.RecordError("create", "", err)
+		infra.GlobalObserver.AddFailed()
+		return true
+	}
+	trace := basic.NewTrace(txid, start)
+	trace.Span("create", "", 1, start, time.Now(), "", nil)
+	op.Attempt++
+	select {
+	case a.raw <- &infra.Elements{TxID: txid, Intended: start, Start: start, Proposal: prop, Trace: trace, Op: op}:
+		return true
+	case <-a.ctx.Done():
+		return false
+	}
+}
+
+// forwardResubmits 生成结束后继续重做，直到没有未确认的交易或者ctx取消。
+// Stop之后不再重做，队列中剩下的操作计为放弃
+func (a *Assembler) forwardResubmits() {
+	if a.resubmits == nil {
+		return
+	}
+	t := time.NewTicker(200 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case op := <-a.resubmits:
+			if !a.resubmitOp(op) {
+				return
+			}
+		case <-t.C:
+			if a.GetUnconfirmed() == 0 {
+				return
+			}
+		case <-a.ctx.Done():
+			return
+		}
+	}
+}
+
+// SetKeyOffset 设置第一个交易使用的key，必须在Start之前调用
+func (a *Assembler) SetKeyOffset(offset uint64) {
+	a.keyOffset = offset
+}
+
+// StartPipeline 启动签名和组装的goroutine，上游的channel关闭后它们退出，
+// 全部退出后关闭下游的Dispatcher
+func (a *Assembler) StartPipeline(signers, integrators int) {
+	var signing, integrating sync.WaitGroup
+	signing.Add(signers)
+	for i := 0; i < signers; i++ {
+		go func() {
+			defer signing.Done()
+			a.StartSigner() // sign proposal
+		}()
+	}
+	integrating.Add(integrators)
+	for i := 0; i < integrators; i++ {
+		go func() {
+			defer integrating.Done()
+			a.StartIntegrator() // create signed tx
+		}()
+	}
+	go func() {
+		signing.Wait()
+		a.proposer.Close()
+	}()
+	go func() {
+		integrating.Wait()
+		a.broadcaster.Close()
+	}()
+}
+
 func (a *Assembler) StartSigner() {
 	for {
 		select {
@@ -130,7 +429,15 @@ func (a *Assembler) StartSigner() {
 			if !ok {
 				return
 			}
-			a.proposer.Send(a.sign(r))
+			if err := a.sign(r); err != nil {
+				a.drop("sign", r, err)
+				continue
+			}
+			if !a.proposer.Send(r) {
+				return
+			}
+		case <-a.ctx.Done():
+			return
 		}
 	}
 }
@@ -142,31 +449,281 @@ func (a *Assembler) StartIntegrator() {
 			if !ok {
 				return
 			}
-			a.broadcaster.Send(a.assemble(p))
+			if err := a.assemble(p); err != nil {
+				a.drop("assemble", p, err)
+				continue
+			}
+			if !a.broadcaster.Send(p) {
+				return
+			}
+		case <-a.ctx.Done():
+			return
 		}
 	}
 }
 
 func (a *Assembler) Stop() {
-	a.stopped = true
+	atomic.StoreInt32(&a.stopped, 1)
+}
+
+// Pause 暂停生成新的交易，已经生成的交易继续处理
+func (a *Assembler) Pause() {
+	atomic.StoreInt32(&a.paused, 1)
+}
+
+func (a *Assembler) Resume() {
+	atomic.StoreInt32(&a.paused, 0)
+}
+
+func (a *Assembler) IsPaused() bool {
+	return atomic.LoadInt32(&a.paused) != 0
+}
+
+func (a *Assembler) IsStopped() bool {
+	return atomic.LoadInt32(&a.stopped) != 0
+}
+
+// SetSpeed 修改目标速度，从下一个时间片开始生效
+func (a *Assembler) SetSpeed(speed uint) error {
+	if speed == 0 {
+		return fmt.Errorf("speed must be positive")
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.speed = speed
+	a.speedSlice = splitSpeed(speed)
+	return nil
+}
+
+// OverrideSpeed 手动修改目标速度，启用了自适应速度时控制器在本次运行中随之暂停
+func (a *Assembler) OverrideSpeed(speed uint) error {
+	if err := a.SetSpeed(speed); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&a.manual, 1)
+	return nil
+}
+
+func (a *Assembler) GetSpeed() uint {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.speed
 }
 
-func (a *Assembler) Wait() {
+// GetGenerated 已经生成的交易数
+func (a *Assembler) GetGenerated() uint64 {
+	return atomic.LoadUint64(&a.real)
+}
+
+// GetCommitted 已经上链的交易数，包括验证失效的
+func (a *Assembler) GetCommitted() uint64 {
+	return infra.GlobalObserver.GetTxNumOfCommitted()
+}
+
+// Wait 等待生成结束，然后最多等待timeout让已生成的交易上链或者失败，
+// 超时或者ctx取消时返回false，未确认的交易数见GetUnconfirmed
+func (a *Assembler) Wait(timeout time.Duration) bool {
 	<-a.done
+	if a.ctx.Err() != nil {
+		return false
+	}
 
-	fmt.Println("waiting for all tx committed to ledger...")
+	basic.Logf("waiting up to %s for all tx committed to ledger...", timeout)
 
+	deadline := time.After(timeout)
 	t := time.NewTicker(200 * time.Millisecond)
+	defer t.Stop()
 	for {
 		select {
 		case <-t.C:
-			if a.real == infra.GlobalObserver.GetTxNumOfObserved() {
-				return
+			if a.GetUnconfirmed() == 0 {
+				return true
+			}
+		case <-deadline:
+			basic.Logf("%d tx not confirmed after %s", a.GetUnconfirmed(), timeout)
+			return false
+		case <-a.ctx.Done():
+			return false
+		}
+	}
+}
+
+// GetUnconfirmed 已经生成(包括重做)但还没有上链也没有失败的交易数
+func (a *Assembler) GetUnconfirmed() uint64 {
+	generated := atomic.LoadUint64(&a.real) + atomic.LoadUint64(&a.resubmitted)
+	observed := infra.GlobalObserver.GetTxNumOfObserved()
+	if observed >= generated {
+		return 0
+	}
+	return generated - observed
+}
+
+// GetScheduleLag 返回生成交易落后于目标速度计划的时间
+func (a *Assembler) GetScheduleLag() time.Duration {
+	return time.Duration(atomic.LoadInt64(&a.lag))
+}
+
+func (a *Assembler) queueDepths() map[string]int {
+	return map[string]int{
+		"raw":         len(a.raw),
+		"proposer":    a.proposer.GetWaitCount(),
+		"broadcaster": a.broadcaster.GetWaitCount(),
+	}
+}
+
+// channels 内部channel的填充情况，raw由签名goroutine消费，proposer.output由组装goroutine消费
+func (a *Assembler) channels() []basic.ChannelFill {
+	channels := []basic.ChannelFill{{Name: "raw", Len: len(a.raw), Cap: cap(a.raw), Local: true}}
+	channels = append(channels, a.proposer.GetChannels("proposer", "signed")...)
+	return append(channels, a.broadcaster.GetChannels("broadcaster", "envs")...)
+}
+
+func (a *Assembler) samplePeaks() {
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-a.ctx.Done():
+			return
+		}
+		depths := a.queueDepths()
+		a.lock.Lock()
+		for q, d := range depths {
+			if d > a.peaks[q] {
+				a.peaks[q] = d
 			}
 		}
+		a.lock.Unlock()
+	}
+}
+
+// Report 汇总到目前为止的运行结果
+func (a *Assembler) Report() *basic.Report {
+	if a.operations != nil {
+		a.operations.Scrape() // 让服务端的统计覆盖到运行结束
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	r := &basic.Report{
+		Config:      a.config,
+		Speed:       a.speed,
+		Total:       a.total,
+		StartTime:   a.startTime,
+		EndTime:     time.Now(),
+		Generated:   atomic.LoadUint64(&a.real),
+		Committed:   infra.GlobalObserver.GetTxNumOfCommitted(),
+		Unconfirmed: a.GetUnconfirmed(),
+		Validation:  infra.GlobalObserver.GetValidationCodes(),
+		Latency:     a.GetLatency(),
+		PeakQueues:  make(map[string]int, len(a.peaks)),
+	}
+	r.Duration = r.EndTime.Sub(r.StartTime).Seconds()
+	if r.Duration > 0 {
+		r.OfferedTPS = float64(r.Generated) / r.Duration
+		r.AchievedTPS = float64(r.Validation["VALID"]) / r.Duration
+	}
+
+	for i := 0; i < basic.ItemButt; i++ {
+		stat := basic.GetStat(i)
+		r.Stages = append(r.Stages, basic.StageReport{
+			Stage:   basic.GetItemDesc(i),
+			Total:   stat.Total,
+			Success: stat.Success,
+			Fail:    stat.Fail,
+			Retried: stat.Retried,
+		})
+	}
+	r.Stages = append(r.Stages, basic.StageReport{
+		Stage:   "commit",
+		Total:   r.Committed,
+		Success: r.Validation["VALID"],
+		Fail:    r.Committed - r.Validation["VALID"],
+	})
+
+	for q, d := range a.peaks {
+		r.PeakQueues[q] = d
 	}
+	if r.Resubmit = infra.GlobalObserver.GetResubmitReport(); r.Resubmit != nil {
+		r.Resubmit.Resubmitted = atomic.LoadUint64(&a.resubmitted)
+	}
+	r.Adaptive = a.adaptReport()
+	r.Endpoints = infra.GetEndpointStats()
+	r.Connections = infra.GetConnectionStats()
+	r.Errors = basic.TopErrors(topErrorNum)
+	r.Client = a.monitor.Report()
+	if a.operations != nil {
+		r.Server = a.operations.Report()
+		r.Health = a.operations.Health()
+	}
+	return r
+}
+
+// Sample 采样当前的累计统计和队列深度
+func (a *Assembler) Sample() *basic.Sample {
+	s := &basic.Sample{
+		Time:        time.Now(),
+		Committed:   infra.GlobalObserver.GetTxNumOfCommitted(),
+		Queues:      a.queueDepths(),
+		TargetRate:  a.GetSpeed(),
+		ScheduleLag: a.GetScheduleLag().Seconds(),
+	}
+	for i := 0; i < basic.ItemButt; i++ {
+		stat := basic.GetStat(i)
+		s.Stages = append(s.Stages, basic.StageSample{
+			Stage:   basic.GetItemDesc(i),
+			Total:   stat.Total,
+			Success: stat.Success,
+			Fail:    stat.Fail,
+			Retried: stat.Retried,
+		})
+	}
+	for _, e := range infra.GetConnectionStats() {
+		s.Endpoints = append(s.Endpoints, basic.NewEndpointSample(e))
+	}
+	s.Errors = basic.TopErrors(topErrorNum)
+	s.Runtime = a.monitor.Get()
+	if a.operations != nil {
+		t, metrics := a.operations.Latest()
+		s.Server = &basic.ServerSample{Time: t, Metrics: metrics}
+	}
+	return s
+}
+
+// SetQuiet 关闭控制台上的区块打印，供全屏界面使用
+func (a *Assembler) SetQuiet(quiet bool) {
+	infra.GlobalObserver.SetQuiet(quiet)
+}
+
+func (a *Assembler) GetLatency() []basic.LatencyReport {
+	return append(infra.GetLatency(), basic.NewLatencyReport("schedule_lag", scheduleLag.With()))
+}
+
+// GetHistograms 返回所有时延直方图，key为阶段名或者stage@addr
+func (a *Assembler) GetHistograms() map[string]basic.HistogramSnapshot {
+	hists := infra.GetHistograms()
+	hists["schedule_lag"] = scheduleLag.With()
+	snapshots := make(map[string]basic.HistogramSnapshot, len(hists))
+	for k, h := range hists {
+		snapshots[k] = h.Snapshot()
+	}
+	return snapshots
+}
+
+func (a *Assembler) GetEndpointInfo() string {
+	return basic.GetEndpointInfo(infra.GetConnectionStats())
+}
+
+func (a *Assembler) GetErrorInfo() string {
+	return basic.GetErrorInfo(basic.TopErrors(topErrorNum))
+}
+
+func (a *Assembler) GetRuntimeInfo() string {
+	return basic.GetRuntimeInfo(a.monitor.Get())
 }
 
 func (a *Assembler) GetInfo() string {
-	return fmt.Sprintf("raw(%10d),signed(%10d),endorsered(%10d)", len(a.raw), a.proposer.GetWaitCount(), a.broadcaster.GetWaitCount())
+	return fmt.Sprintf("raw(%10d),signed(%10d),endorsered(%10d),lag(%v)", len(a.raw), a.proposer.GetWaitCount(), a.broadcaster.GetWaitCount(), a.GetScheduleLag())
 }
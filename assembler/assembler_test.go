@@ -0,0 +1,52 @@
+package assembler
+
+import (
+	"context"
+	"github.com/hcg1314/stupid/assembler/infra"
+	"sync/atomic"
+	"testing"
+)
+
+// Stop之后Observer交来的操作不再接受，已经在队列中的计为放弃，都不会生成新的交易
+func TestResubmitAfterStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	infra.GlobalObserver = &infra.Observer{}
+	a := &Assembler{
+		ctx:       ctx,
+		cancel:    cancel,
+		raw:       make(chan *infra.Elements, 1),
+		resubmits: make(chan infra.Operation, 1),
+	}
+	op := infra.Operation{Key: "k", Attempt: 1}
+
+	if !a.onInvalid(op) {
+		t.Fatal("expect the operation accepted before Stop")
+	}
+	if a.onInvalid(op) {
+		t.Fatal("expect the operation rejected when the queue is full")
+	}
+	if n := atomic.LoadUint64(&a.resubmitted); n != 1 {
+		t.Fatalf("expect 1 resubmitted, got %d", n)
+	}
+
+	a.Stop()
+	if a.onInvalid(op) {
+		t.Fatal("expect the operation rejected after Stop")
+	}
+	if !a.resubmitOp(<-a.resubmits) {
+		t.Fatal("expect resubmitOp to continue after giving up")
+	}
+	if len(a.raw) != 0 {
+		t.Fatal("resubmitted after Stop")
+	}
+	if n := atomic.LoadUint64(&a.resubmitted); n != 0 {
+		t.Fatalf("expect the given up operation removed from resubmitted, got %d", n)
+	}
+
+	cancel()
+	a = &Assembler{ctx: ctx, cancel: cancel, resubmits: make(chan infra.Operation, 1)}
+	if a.onInvalid(op) {
+		t.Fatal("expect the operation rejected after ctx canceled")
+	}
+}
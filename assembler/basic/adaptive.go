@@ -0,0 +1,171 @@
+package basic
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	AdaptiveAIMD = "aimd"
+	AdaptivePID  = "pid"
+)
+
+// AdaptiveConfig 自适应速度：出错、队列堆积或者时延超过目标时降低速度，恢复后再提高。
+// Mode为空时不启用，按固定速度生成
+type AdaptiveConfig struct {
+	Mode          string  `json:"mode"`           // aimd或pid
+	Interval      string  `json:"interval"`       // 调整间隔，默认1s
+	MinRate       uint    `json:"min_rate"`       // 默认1
+	MaxRate       uint    `json:"max_rate"`       // 默认为启动时的目标速度
+	MaxErrorRate  float64 `json:"max_error_rate"` // 一个间隔内失败和重试占尝试的比例上限，默认0.01
+	MaxQueueFill  float64 `json:"max_queue_fill"` // 任一队列的填充比例上限，默认0.5
+	TargetLatency string  `json:"target_latency"` // 一个间隔内上链平均时延的上限，为空时不看时延
+
+	Increase uint    `json:"increase"` // aimd每次增加的速度，默认为MaxRate的5%
+	Decrease float64 `json:"decrease"` // aimd降速时乘的系数，默认0.7
+
+	Kp float64 `json:"kp"` // pid的系数，作用于1减去归一化的压力，默认0.2、0.1、0
+	Ki float64 `json:"ki"`
+	Kd float64 `json:"kd"`
+}
+
+// RateSignal 一个调整间隔内观察到的情况
+type RateSignal struct {
+	ErrorRate float64 // 失败和重试占尝试的比例
+	QueueFill float64 // 填充比例最高的队列
+	Latency   float64 // 上链平均时延，秒，没有交易上链时为0
+}
+
+// RateController 根据RateSignal调整速度，不是并发安全的
+type RateController struct {
+	Mode     string
+	Interval time.Duration
+	Min, Max uint
+
+	maxError float64
+	maxFill  float64
+	latency  float64
+	increase float64
+	decrease float64
+	kp       float64
+	ki       float64
+	kd       float64
+
+	rate float64
+	last float64 // 上一次的偏差
+	prev float64 // 再上一次的偏差
+}
+
+// Controller speed为启动时的目标速度，Mode为空时返回nil
+func (c AdaptiveConfig) Controller(speed uint) (*RateController, error) {
+	if c.Mode == "" {
+		return nil, nil
+	}
+	if c.Mode != AdaptiveAIMD && c.Mode != AdaptivePID {
+		return nil, fmt.Errorf("mode must be %s or %s, got %s", AdaptiveAIMD, AdaptivePID, c.Mode)
+	}
+	r := &RateController{
+		Mode:     c.Mode,
+		Interval: time.Second,
+		Min:      c.MinRate,
+		Max:      c.MaxRate,
+		maxError: c.MaxErrorRate,
+		maxFill:  c.MaxQueueFill,
+		increase: float64(c.Increase),
+		decrease: c.Decrease,
+		kp:       c.Kp,
+		ki:       c.Ki,
+		kd:       c.Kd,
+		rate:     float64(speed),
+	}
+	if c.Interval != "" {
+		d, err := time.ParseDuration(c.Interval)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("interval must be positive, got %s", c.Interval)
+		}
+		r.Interval = d
+	}
+	if c.TargetLatency != "" {
+		d, err := time.ParseDuration(c.TargetLatency)
+		if err != nil {
+			return nil, err
+		}
+		r.latency = d.Seconds()
+	}
+	if r.Min == 0 {
+		r.Min = 1
+	}
+	if r.Max == 0 {
+		r.Max = speed
+	}
+	if r.Min > r.Max {
+		return nil, fmt.Errorf("min_rate %d is larger than max_rate %d", r.Min, r.Max)
+	}
+	if r.maxError == 0 {
+		r.maxError = 0.01
+	}
+	if r.maxFill == 0 {
+		r.maxFill = 0.5
+	}
+	if r.increase == 0 {
+		r.increase = math.Max(1, float64(r.Max)*0.05)
+	}
+	if r.decrease == 0 {
+		r.decrease = 0.7
+	}
+	if r.decrease <= 0 || r.decrease >= 1 {
+		return nil, fmt.Errorf("decrease must be between 0 and 1, got %g", r.decrease)
+	}
+	if r.kp == 0 && r.ki == 0 && r.kd == 0 {
+		r.kp, r.ki = 0.2, 0.1
+	}
+	return r, nil
+}
+
+// pressure 各项指标相对上限的最大比值以及对应的原因，超过1说明过载
+func (r *RateController) pressure(s RateSignal) (float64, string) {
+	p, reason := s.ErrorRate/r.maxError, fmt.Sprintf("error rate %.2f%%", s.ErrorRate*100)
+	if q := s.QueueFill / r.maxFill; q > p {
+		p, reason = q, fmt.Sprintf("queue fill %.0f%%", s.QueueFill*100)
+	}
+	if r.latency > 0 {
+		if l := s.Latency / r.latency; l > p {
+			p, reason = l, fmt.Sprintf("commit latency %.0fms", s.Latency*1e3)
+		}
+	}
+	return p, reason
+}
+
+// Next current为当前速度，可能已经被手动修改过；返回新的速度以及调整的原因
+func (r *RateController) Next(current uint, s RateSignal) (uint, string) {
+	if current != r.round() {
+		r.rate = float64(current)
+	}
+	p, reason := r.pressure(s)
+	switch r.Mode {
+	case AdaptiveAIMD:
+		if p > 1 {
+			r.rate *= r.decrease
+			reason += ", decrease"
+		} else {
+			r.rate += r.increase
+			reason += ", increase"
+		}
+	case AdaptivePID:
+		// 增量式PID，偏差为负时降速，以最大速度为尺度。速度本身被限制在上下限之间，不会积分饱和
+		e := 1 - p
+		r.rate += (r.kp*(e-r.last) + r.ki*e + r.kd*(e-2*r.last+r.prev)) * float64(r.Max)
+		r.prev, r.last = r.last, e
+		reason += fmt.Sprintf(", pressure %.2f", p)
+	}
+	r.rate = math.Max(float64(r.Min), math.Min(float64(r.Max), r.rate))
+	return r.round(), reason
+}
+
+func (r *RateController) round() uint {
+	return uint(math.Round(r.rate))
+}
@@ -0,0 +1,93 @@
+package basic
+
+import (
+	"math"
+	"testing"
+)
+
+var (
+	healthy   = RateSignal{ErrorRate: 0, QueueFill: 0.1}
+	saturated = RateSignal{QueueFill: 0.9} // 超过默认上限0.5
+)
+
+func controller(t *testing.T, c AdaptiveConfig, speed uint) *RateController {
+	r, err := c.Controller(speed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestAIMD(t *testing.T) {
+	r := controller(t, AdaptiveConfig{Mode: AdaptiveAIMD, MinRate: 100, Increase: 50, Decrease: 0.5}, 1000)
+
+	// 过载时按比例降速，直到下限
+	rate := uint(1000)
+	for _, want := range []uint{500, 250, 125, 100, 100} {
+		rate, _ = r.Next(rate, saturated)
+		if rate != want {
+			t.Fatalf("saturated: expect %d, got %d", want, rate)
+		}
+	}
+	// 恢复后线性提速，不超过上限(默认为启动速度)
+	for _, want := range []uint{150, 200, 250} {
+		rate, _ = r.Next(rate, healthy)
+		if rate != want {
+			t.Fatalf("healthy: expect %d, got %d", want, rate)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		rate, _ = r.Next(rate, healthy)
+	}
+	if rate != 1000 {
+		t.Errorf("expect clamped to max 1000, got %d", rate)
+	}
+
+	// 手动修改过的速度作为新的起点
+	if rate, _ = r.Next(400, saturated); rate != 200 {
+		t.Errorf("expect 200 from a manual 400, got %d", rate)
+	}
+}
+
+func TestPIDBackoffAndClamp(t *testing.T) {
+	r := controller(t, AdaptiveConfig{Mode: AdaptivePID, MinRate: 10}, 1000)
+	rate := uint(1000)
+	for i := 0; i < 5; i++ {
+		next, reason := r.Next(rate, saturated)
+		if next >= rate {
+			t.Fatalf("step %d: expect backoff from %d under saturation, got %d (%s)", i, rate, next, reason)
+		}
+		rate = next
+	}
+	for i := 0; i < 100; i++ {
+		rate, _ = r.Next(rate, RateSignal{ErrorRate: 1})
+	}
+	if rate != 10 {
+		t.Errorf("expect clamped to min 10, got %d", rate)
+	}
+	for i := 0; i < 100; i++ {
+		rate, _ = r.Next(rate, healthy)
+	}
+	if rate != 1000 {
+		t.Errorf("expect clamped to max 1000, got %d", rate)
+	}
+}
+
+// 队列填充和速度成正比，800tx/s时正好到达上限，速度应该稳定在800附近
+func TestPIDSettles(t *testing.T) {
+	r := controller(t, AdaptiveConfig{Mode: AdaptivePID}, 1000)
+	rate := uint(1000)
+	for i := 0; i < 100; i++ {
+		rate, _ = r.Next(rate, RateSignal{QueueFill: 0.5 * float64(rate) / 800})
+	}
+	if math.Abs(float64(rate)-800) > 8 {
+		t.Errorf("expect settled around 800, got %d", rate)
+	}
+	for i := 0; i < 10; i++ {
+		next, _ := r.Next(rate, RateSignal{QueueFill: 0.5 * float64(rate) / 800})
+		if d := int(next) - int(rate); d > 1 || d < -1 {
+			t.Errorf("still moving after settling: %d -> %d", rate, next)
+		}
+		rate = next
+	}
+}
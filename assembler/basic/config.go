@@ -1,8 +1,12 @@
 package basic
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"strings"
+	"time"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/hyperledger/fabric/protos/msp"
@@ -11,6 +15,8 @@ import (
 type Node struct {
 	Addr         string `json:"addr"`
 	OverrideName string `json:"override_name"`
+	Operations   string `json:"operations"` // 运维端口，如http://peer0:9443，为空时不抓取
+	Weight       int    `json:"weight"`     // weighted和hash路由时的权重，默认1
 }
 
 type Config struct {
@@ -24,23 +30,174 @@ type Config struct {
 	TLSCACerts    []string `json:"tls_ca_certs"`
 	NumOfConn     int      `json:"num_of_conn"`
 	ClientPerConn int      `json:"client_per_conn"`
+
+	Sinks   []SinkConfig `json:"sinks"`
+	Tracing *TraceConfig `json:"tracing"`
+
+	OperationsMetrics  []string `json:"operations_metrics"`  // 为空时使用DefaultOperationsMetrics
+	OperationsInterval string   `json:"operations_interval"` // 抓取间隔，默认5s
+
+	RPCTimeout string `json:"rpc_timeout"` // 背书请求和建立区块订阅的超时，默认30s
+
+	Reconnect ReconnectConfig        `json:"broadcast_reconnect"`
+	Retry     map[string]RetryConfig `json:"retry"` // key为阶段名，proposal或broadcast
+	Resubmit  ResubmitConfig         `json:"resubmit"`
+	Adaptive  AdaptiveConfig         `json:"adaptive_rate"`
+	Routing   RoutingConfig          `json:"routing"`
 }
 
-func LoadConfig(f string) *Config {
+// RoutingConfig Dispatcher把交易分给各个连接的策略，默认round_robin
+type RoutingConfig struct {
+	Proposal  string `json:"proposal"`
+	Broadcast string `json:"broadcast"`
+}
+
+const (
+	RouteRoundRobin   = "round_robin"   // 依次轮流
+	RouteLeastQueued  = "least_queued"  // 队列最短
+	RouteLeastLatency = "least_latency" // 时延EWMA乘以队列长度最小
+	RouteWeighted     = "weighted"      // 按节点权重的平滑加权轮询
+	RouteHash         = "hash"          // 按key一致性哈希，重做时发往同一个连接
+)
+
+// RouteStrategies 所有路由策略的名字
+var RouteStrategies = []string{RouteRoundRobin, RouteLeastQueued, RouteLeastLatency, RouteWeighted, RouteHash}
+
+// ResubmitConfig 自己的交易上链时因为这些验证码失效，就用新的交易重做同一个操作，
+// 和应用程序处理MVCC冲突的方式一样
+type ResubmitConfig struct {
+	MaxAttempts int      `json:"max_attempts"` // 包括第一次在内最多提交几次，不超过1时不重做
+	Codes       []string `json:"codes"`        // 默认只有MVCC_READ_CONFLICT
+}
+
+// GetCodes 返回需要重做的验证码
+func (r ResubmitConfig) GetCodes() []string {
+	if len(r.Codes) == 0 {
+		return []string{"MVCC_READ_CONFLICT"}
+	}
+	return r.Codes
+}
+
+// ReconnectConfig broadcast流断开后的重连策略
+type ReconnectConfig struct {
+	MinBackoff string `json:"min_backoff"` // 第一次重连前等待的时间，之后每次加倍，默认100ms
+	MaxBackoff string `json:"max_backoff"` // 默认10s
+	InFlight   string `json:"in_flight"`   // 已发送但没有收到应答的交易：resend重发，lost计为失败，默认lost
+}
+
+const (
+	InFlightResend = "resend"
+	InFlightLost   = "lost"
+)
+
+const defaultRPCTimeout = 30 * time.Second
+
+// LoadConfig 读取并检查配置，拒绝未知字段，所有问题在一个错误中列出
+func LoadConfig(f string) (*Config, error) {
 	raw, err := ioutil.ReadFile(f)
 	if err != nil {
-		panic(err)
+		return nil, WrapError(ErrConfig, err, "read config")
 	}
 
+	// 拼错的字段不会被悄悄忽略
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
 	config := &Config{}
-	if err = json.Unmarshal(raw, config); err != nil {
-		panic(err)
+	if err = dec.Decode(config); err != nil {
+		return nil, WrapError(ErrConfig, err, "parse config %s", f)
 	}
+	if err = config.Validate(f); err != nil {
+		return nil, &Error{Kind: ErrConfig, Err: err}
+	}
+
+	return config, nil
+}
 
-	return config
+// GetOperationsTargets 配置了运维端口的peer和orderer
+func (c Config) GetOperationsTargets() []OperationsTarget {
+	var targets []OperationsTarget
+	for _, n := range append(append([]Node(nil), c.Peers...), c.Orderer) {
+		if n.Operations != "" {
+			targets = append(targets, OperationsTarget{Node: n.Addr, URL: strings.TrimSuffix(n.Operations, "/")})
+		}
+	}
+	return targets
 }
 
-func (c Config) LoadCrypto() *Crypto {
+func (c Config) GetOperationsInterval() (time.Duration, error) {
+	if c.OperationsInterval == "" {
+		return defaultOperationsInterval, nil
+	}
+	d, err := time.ParseDuration(c.OperationsInterval)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("operations interval must be positive, got %s", c.OperationsInterval)
+	}
+	return d, nil
+}
+
+func (c Config) GetRPCTimeout() (time.Duration, error) {
+	if c.RPCTimeout == "" {
+		return defaultRPCTimeout, nil
+	}
+	d, err := time.ParseDuration(c.RPCTimeout)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("rpc timeout must be positive, got %s", c.RPCTimeout)
+	}
+	return d, nil
+}
+
+// GetBackoff 返回重连的最小和最大退避时间
+func (r ReconnectConfig) GetBackoff() (time.Duration, time.Duration, error) {
+	lo, hi := 100*time.Millisecond, 10*time.Second
+	var err error
+	if r.MinBackoff != "" {
+		if lo, err = time.ParseDuration(r.MinBackoff); err != nil {
+			return 0, 0, err
+		}
+	}
+	if r.MaxBackoff != "" {
+		if hi, err = time.ParseDuration(r.MaxBackoff); err != nil {
+			return 0, 0, err
+		}
+	}
+	if lo <= 0 || hi < lo {
+		return 0, 0, fmt.Errorf("backoff must satisfy 0 < min_backoff <= max_backoff, got %s and %s", lo, hi)
+	}
+	return lo, hi, nil
+}
+
+// ResendInFlight 重连后是否重发没有收到应答的交易
+func (r ReconnectConfig) ResendInFlight() (bool, error) {
+	switch r.InFlight {
+	case InFlightResend:
+		return true, nil
+	case "", InFlightLost:
+		return false, nil
+	}
+	return false, fmt.Errorf("in_flight must be %s or %s, got %s", InFlightResend, InFlightLost, r.InFlight)
+}
+
+// GetRetryPolicy 返回阶段的重试策略，没有配置时为nil
+func (c Config) GetRetryPolicy(stage string) (*RetryPolicy, error) {
+	for k := range c.Retry {
+		if k != "proposal" && k != "broadcast" {
+			return nil, fmt.Errorf("retry stage must be proposal or broadcast, got %s", k)
+		}
+	}
+	p, err := c.Retry[stage].Policy()
+	if err != nil {
+		return nil, fmt.Errorf("retry %s: %s", stage, err)
+	}
+	return p, nil
+}
+
+func (c Config) LoadCrypto() (*Crypto, error) {
 	conf := CryptoConfig{
 		MSPID:      c.MSPID,
 		PrivKey:    c.PrivateKey,
@@ -50,12 +207,12 @@ func (c Config) LoadCrypto() *Crypto {
 
 	priv, err := GetPrivateKey(conf.PrivKey)
 	if err != nil {
-		panic(err)
+		return nil, WrapError(ErrCrypto, err, "load private key %s", conf.PrivKey)
 	}
 
 	cert, certBytes, err := GetCertificate(conf.SignCert)
 	if err != nil {
-		panic(err)
+		return nil, WrapError(ErrCrypto, err, "load sign cert %s", conf.SignCert)
 	}
 
 	id := &msp.SerializedIdentity{
@@ -65,12 +222,12 @@ func (c Config) LoadCrypto() *Crypto {
 
 	name, err := proto.Marshal(id)
 	if err != nil {
-		panic(err)
+		return nil, WrapError(ErrCrypto, err, "marshal identity")
 	}
 
 	certs, err := GetTLSCACerts(conf.TLSCACerts)
 	if err != nil {
-		panic(err)
+		return nil, WrapError(ErrCrypto, err, "load tls ca certs")
 	}
 
 	return &Crypto{
@@ -78,5 +235,5 @@ func (c Config) LoadCrypto() *Crypto {
 		PrivKey:    priv,
 		SignCert:   cert,
 		TLSCACerts: certs,
-	}
+	}, nil
 }
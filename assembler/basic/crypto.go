@@ -124,6 +124,9 @@ func GetCertificate(f string) (*x509.Certificate, []byte, error) {
 	}
 
 	block, _ := pem.Decode(in)
+	if block == nil {
+		return nil, nil, errors.Errorf("no PEM data found in %s", f)
+	}
 
 	c, err := x509.ParseCertificate(block.Bytes)
 	return c, in, err
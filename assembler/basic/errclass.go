@@ -0,0 +1,151 @@
+package basic
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+const maxMessageLen = 200
+
+var (
+	hexPattern    = regexp.MustCompile(`[0-9a-fA-F]{16,}`)
+	numberPattern = regexp.MustCompile(`[0-9]+`)
+)
+
+// ErrorClass 一类错误，按阶段、节点、gRPC状态码、背书/广播状态和归一化后的消息聚合
+type ErrorClass struct {
+	Stage     string    `json:"stage"`
+	Endpoint  string    `json:"endpoint"`
+	Code      string    `json:"grpc_code,omitempty"`
+	Status    int32     `json:"status,omitempty"`
+	Message   string    `json:"message"`
+	Count     uint64    `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+func (c *ErrorClass) key() string {
+	return strings.Join([]string{c.Stage, c.Endpoint, c.Code, fmt.Sprint(c.Status), c.Message}, "|")
+}
+
+var globalErrors = &errorAggregator{
+	classes: make(map[string]*ErrorClass),
+	limit:   10,
+}
+
+type errorAggregator struct {
+	lock    sync.Mutex
+	classes map[string]*ErrorClass
+
+	// 原始错误信息每秒最多打印limit条
+	limit      int
+	window     time.Time
+	printed    int
+	suppressed int
+}
+
+// SetErrorSampleRate 设置每秒最多打印多少条原始错误信息，0表示不打印
+func SetErrorSampleRate(limit int) {
+	globalErrors.lock.Lock()
+	defer globalErrors.lock.Unlock()
+	globalErrors.limit = limit
+}
+
+// RecordError 记录一次RPC错误，gRPC状态码从err中解析
+func RecordError(stage, endpoint string, err error) {
+	c := &ErrorClass{Stage: stage, Endpoint: endpoint, Message: err.Error()}
+	if s, ok := status.FromError(err); ok {
+		c.Code = s.Code().String()
+		c.Message = s.Message()
+	}
+	globalErrors.record(c, err.Error())
+}
+
+// RecordStatus 记录一次非成功的背书或广播应答
+func RecordStatus(stage, endpoint string, status int32, msg string) {
+	c := &ErrorClass{Stage: stage, Endpoint: endpoint, Status: status, Message: msg}
+	globalErrors.record(c, fmt.Sprintf("status: %d, %s", status, msg))
+}
+
+// TopErrors 按次数从多到少返回前n类错误，n<=0时返回全部
+func TopErrors(n int) []ErrorClass {
+	return globalErrors.top(n)
+}
+
+func normalize(msg string) string {
+	msg = hexPattern.ReplaceAllString(msg, "<hex>")
+	msg = numberPattern.ReplaceAllString(msg, "<n>")
+	if len(msg) > maxMessageLen {
+		msg = msg[:maxMessageLen] + "..."
+	}
+	return msg
+}
+
+func (ea *errorAggregator) record(c *ErrorClass, raw string) {
+	now := time.Now()
+	c.Message = normalize(c.Message)
+	key := c.key()
+
+	ea.lock.Lock()
+	defer ea.lock.Unlock()
+
+	exist, ok := ea.classes[key]
+	if !ok {
+		c.FirstSeen = now
+		ea.classes[key] = c
+		exist = c
+	}
+	exist.Count += 1
+	exist.LastSeen = now
+
+	if now.Sub(ea.window) >= time.Second {
+		// limit为0时(例如全屏界面)不打印原始错误，也就没有需要提示的
+		if ea.suppressed > 0 && ea.limit > 0 {
+			Logf("... %d more errors suppressed", ea.suppressed)
+		}
+		ea.window, ea.printed, ea.suppressed = now, 0, 0
+	}
+	if ea.printed < ea.limit {
+		ea.printed += 1
+		Logf("Err %s %s: %s", c.Stage, c.Endpoint, raw)
+	} else {
+		ea.suppressed += 1
+	}
+}
+
+func (ea *errorAggregator) top(n int) []ErrorClass {
+	ea.lock.Lock()
+	list := make([]ErrorClass, 0, len(ea.classes))
+	for _, c := range ea.classes {
+		list = append(list, *c)
+	}
+	ea.lock.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].FirstSeen.Before(list[j].FirstSeen)
+	})
+	if n > 0 && len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// GetErrorInfo 以表格形式输出错误分类
+func GetErrorInfo(list []ErrorClass) string {
+	info := "Errors:\n"
+	for _, c := range list {
+		info += fmt.Sprintf("%10d  %-10s%-25s%-18s%5d  first %s  last %s  %s\n",
+			c.Count, c.Stage, c.Endpoint, c.Code, c.Status,
+			c.FirstSeen.Format("15:04:05"), c.LastSeen.Format("15:04:05"), c.Message)
+	}
+	return info
+}
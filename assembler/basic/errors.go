@@ -0,0 +1,47 @@
+package basic
+
+import (
+	"fmt"
+)
+
+// ErrorKind 错误的类别，可以用errors.Is(err, basic.ErrConnection)判断
+type ErrorKind string
+
+const (
+	ErrConfig      ErrorKind = "config"      // 配置文件读取、解析或者取值错误
+	ErrCrypto      ErrorKind = "crypto"      // 私钥、证书读取以及签名错误
+	ErrConnection  ErrorKind = "connection"  // 连接peer或orderer失败
+	ErrEndorsement ErrorKind = "endorsement" // 背书结果无法组装成交易
+)
+
+func (k ErrorKind) Error() string {
+	return string(k) + " error"
+}
+
+// Error 带类别的错误，Err保留原始错误
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+// WrapError 给err加上说明和类别，err为nil时返回nil
+func WrapError(kind ErrorKind, err error, format string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), err)}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s error: %s", string(e.Kind), e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is 同类别的ErrorKind视为相同
+func (e *Error) Is(target error) bool {
+	k, ok := target.(ErrorKind)
+	return ok && k == e.Kind
+}
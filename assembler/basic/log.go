@@ -0,0 +1,35 @@
+package basic
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// 运行中的提示和告警都经过Logf输出，全屏界面运行时可以把它们接管过去，避免打乱屏幕
+var logger = struct {
+	lock sync.Mutex
+	out  io.Writer
+}{out: os.Stdout}
+
+// SetLogOutput 修改Logf的输出，返回原来的输出以便恢复；w为nil时丢弃
+func SetLogOutput(w io.Writer) io.Writer {
+	if w == nil {
+		w = ioutil.Discard
+	}
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	old := logger.out
+	logger.out = w
+	return old
+}
+
+// Logf 输出一行提示，format不需要换行
+func Logf(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...) + "\n"
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	_, _ = io.WriteString(logger.out, line)
+}
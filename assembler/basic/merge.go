@@ -0,0 +1,235 @@
+package basic
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// WorkerResult 分布式压测中一个worker的报告和时延直方图，
+// 直方图的key为阶段名或者stage@addr
+type WorkerResult struct {
+	Worker     string                       `json:"worker"`
+	Report     *Report                      `json:"report"`
+	Histograms map[string]HistogramSnapshot `json:"histograms"`
+}
+
+// WorkerSummary 合并报告中每个worker的概况
+type WorkerSummary struct {
+	Worker      string  `json:"worker"`
+	Speed       uint    `json:"speed"`
+	Total       uint64  `json:"total"`
+	Generated   uint64  `json:"generated"`
+	Committed   uint64  `json:"committed"`
+	AchievedTPS float64 `json:"achieved_tps"`
+	Saturated   bool    `json:"saturated"`
+}
+
+// MergeReports 把多个worker的报告合并成一个，计数相加，时延由直方图重新计算。
+// 每个连接的统计和队列峰值保留各自的worker，名字前面加上worker地址
+func MergeReports(config *Config, results []WorkerResult) (*Report, error) {
+	r := &Report{
+		Config:     config,
+		Validation: make(map[string]uint64),
+		PeakQueues: make(map[string]int),
+		Client: ClientReport{
+			PeakChannels: make(map[string]float64),
+			Reasons:      make(map[string]int),
+		},
+	}
+	hists := make(map[string]*Histogram)
+	stages := make(map[string]int)
+	latencies := make(map[string]bool)
+	endpoints := make(map[string]int)
+	errors := make(map[string]*ErrorClass)
+
+	for _, res := range results {
+		w := res.Report
+		if w == nil {
+			return nil, fmt.Errorf("worker %s returned no report", res.Worker)
+		}
+		for k, s := range res.Histograms {
+			h, err := s.Histogram()
+			if err != nil {
+				return nil, fmt.Errorf("worker %s histogram %s: %s", res.Worker, k, err)
+			}
+			if hists[k] == nil {
+				hists[k] = NewHistogram(h.upper)
+			}
+			if len(hists[k].upper) != len(h.upper) {
+				return nil, fmt.Errorf("worker %s histogram %s has different buckets", res.Worker, k)
+			}
+			hists[k].Merge(h)
+		}
+
+		r.Speed += w.Speed
+		if r.Total > math.MaxUint64-w.Total {
+			r.Total = math.MaxUint64
+		} else {
+			r.Total += w.Total
+		}
+		if r.StartTime.IsZero() || w.StartTime.Before(r.StartTime) {
+			r.StartTime = w.StartTime
+		}
+		if w.EndTime.After(r.EndTime) {
+			r.EndTime = w.EndTime
+		}
+		r.Generated += w.Generated
+		r.Committed += w.Committed
+		r.Unconfirmed += w.Unconfirmed
+		for code, n := range w.Validation {
+			r.Validation[code] += n
+		}
+
+		for _, s := range w.Stages {
+			i, ok := stages[s.Stage]
+			if !ok {
+				i = len(r.Stages)
+				stages[s.Stage] = i
+				r.Stages = append(r.Stages, StageReport{Stage: s.Stage})
+			}
+			r.Stages[i].Total += s.Total
+			r.Stages[i].Success += s.Success
+			r.Stages[i].Fail += s.Fail
+			r.Stages[i].Retried += s.Retried
+		}
+		for _, l := range w.Latency {
+			if !latencies[l.Stage] {
+				latencies[l.Stage] = true
+				r.Latency = append(r.Latency, LatencyReport{Stage: l.Stage})
+			}
+		}
+
+		for q, d := range w.PeakQueues {
+			r.PeakQueues[res.Worker+"/"+q] = d
+		}
+		for _, e := range w.Endpoints {
+			key := e.Stage + "@" + e.Endpoint
+			i, ok := endpoints[key]
+			if !ok {
+				i = len(r.Endpoints)
+				endpoints[key] = i
+				r.Endpoints = append(r.Endpoints, EndpointReport{Stage: e.Stage, Endpoint: e.Endpoint, Conn: -1})
+			}
+			r.Endpoints[i].Total += e.Total
+			r.Endpoints[i].Success += e.Success
+			r.Endpoints[i].Fail += e.Fail
+			r.Endpoints[i].Retried += e.Retried
+			r.Endpoints[i].Routed += e.Routed
+			r.Endpoints[i].Reconnects += e.Reconnects
+			r.Endpoints[i].Resent += e.Resent
+			r.Endpoints[i].Lost += e.Lost
+		}
+		for _, c := range w.Connections {
+			c.Endpoint = res.Worker + "/" + c.Endpoint
+			r.Connections = append(r.Connections, c)
+		}
+		// 错误按节点合并，不区分worker
+		for _, e := range w.Errors {
+			if old, ok := errors[e.key()]; ok {
+				old.Count += e.Count
+				if e.FirstSeen.Before(old.FirstSeen) {
+					old.FirstSeen = e.FirstSeen
+				}
+				if e.LastSeen.After(old.LastSeen) {
+					old.LastSeen = e.LastSeen
+				}
+				continue
+			}
+			e := e
+			errors[e.key()] = &e
+		}
+
+		if rs := w.Resubmit; rs != nil {
+			if r.Resubmit == nil {
+				r.Resubmit = &ResubmitReport{Attempts: make(map[int]uint64)}
+			}
+			if rs.MaxAttempts > r.Resubmit.MaxAttempts {
+				r.Resubmit.MaxAttempts = rs.MaxAttempts
+			}
+			r.Resubmit.Resubmitted += rs.Resubmitted
+			r.Resubmit.GaveUp += rs.GaveUp
+			for n, c := range rs.Attempts {
+				r.Resubmit.Attempts[n] += c
+			}
+		}
+
+		if ad := w.Adaptive; ad != nil {
+			if r.Adaptive == nil {
+				r.Adaptive = &AdaptiveReport{Mode: ad.Mode}
+			}
+			r.Adaptive.Initial += ad.Initial
+			r.Adaptive.Final += ad.Final
+			r.Adaptive.Settled += ad.Settled
+			r.Adaptive.Lowest += ad.Lowest
+			r.Adaptive.Increases += ad.Increases
+			r.Adaptive.Decreases += ad.Decreases
+		}
+
+		mergeClient(&r.Client, &w.Client)
+		// 服务端指标和健康检查只取第一个配置了运维端口的worker，避免重复计数
+		if r.Server == nil {
+			r.Server, r.Health = w.Server, w.Health
+		}
+
+		r.Workers = append(r.Workers, WorkerSummary{
+			Worker:      res.Worker,
+			Speed:       w.Speed,
+			Total:       w.Total,
+			Generated:   w.Generated,
+			Committed:   w.Committed,
+			AchievedTPS: w.AchievedTPS,
+			Saturated:   w.Client.Saturated(),
+		})
+	}
+
+	for i := range r.Latency {
+		if h := hists[r.Latency[i].Stage]; h != nil {
+			r.Latency[i] = NewLatencyReport(r.Latency[i].Stage, h)
+		}
+	}
+	for i := range r.Endpoints {
+		e := &r.Endpoints[i]
+		if h := hists[e.Stage+"@"+e.Endpoint]; h != nil {
+			e.Latency = NewLatencyReport(e.Stage, h)
+		}
+	}
+	if r.Resubmit != nil {
+		if h := hists["operation"]; h != nil {
+			r.Resubmit.Latency = NewLatencyReport("operation", h)
+		}
+	}
+	for _, e := range errors {
+		r.Errors = append(r.Errors, *e)
+	}
+	sort.Slice(r.Errors, func(i, j int) bool { return r.Errors[i].Count > r.Errors[j].Count })
+
+	r.Duration = r.EndTime.Sub(r.StartTime).Seconds()
+	if r.Duration > 0 {
+		r.OfferedTPS = float64(r.Generated) / r.Duration
+		r.AchievedTPS = float64(r.Validation["VALID"]) / r.Duration
+	}
+	return r, nil
+}
+
+// mergeClient 峰值取最大，计数相加
+func mergeClient(dst, src *ClientReport) {
+	dst.Samples += src.Samples
+	dst.SaturatedSamples += src.SaturatedSamples
+	dst.NumGC += src.NumGC
+	dst.GCPauseTotal += src.GCPauseTotal
+	dst.PeakCPU = math.Max(dst.PeakCPU, src.PeakCPU)
+	dst.GCPauseMax = math.Max(dst.GCPauseMax, src.GCPauseMax)
+	if src.PeakGoroutines > dst.PeakGoroutines {
+		dst.PeakGoroutines = src.PeakGoroutines
+	}
+	if src.PeakHeapBytes > dst.PeakHeapBytes {
+		dst.PeakHeapBytes = src.PeakHeapBytes
+	}
+	for k, v := range src.PeakChannels {
+		dst.PeakChannels[k] = math.Max(dst.PeakChannels[k], v)
+	}
+	for k, v := range src.Reasons {
+		dst.Reasons[k] += v
+	}
+}
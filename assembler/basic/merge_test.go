@@ -0,0 +1,96 @@
+package basic
+
+import (
+	"testing"
+	"time"
+)
+
+func workerResult(name string, values []float64, errors ...ErrorClass) WorkerResult {
+	h := NewHistogram([]float64{10, 20, 50, 100})
+	for _, v := range values {
+		h.Observe(v)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return WorkerResult{
+		Worker: name,
+		Report: &Report{
+			Speed:      100,
+			Total:      uint64(len(values)),
+			StartTime:  start,
+			EndTime:    start.Add(10 * time.Second),
+			Generated:  uint64(len(values)),
+			Committed:  uint64(len(values)),
+			Validation: map[string]uint64{"VALID": uint64(len(values))},
+			Latency:    []LatencyReport{NewLatencyReport("commit", h)},
+			Errors:     errors,
+		},
+		Histograms: map[string]HistogramSnapshot{"commit": h.Snapshot()},
+	}
+}
+
+// 合并后的分位数由合并的直方图重新计算，不是各worker分位数的平均
+func TestMergeReportsHistogram(t *testing.T) {
+	fast := make([]float64, 90)
+	for i := range fast {
+		fast[i] = 5
+	}
+	slow := make([]float64, 10)
+	for i := range slow {
+		slow[i] = 80
+	}
+	r, err := MergeReports(&Config{}, []WorkerResult{workerResult("a", fast), workerResult("b", slow)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Speed != 200 || r.Generated != 100 || r.Validation["VALID"] != 100 || len(r.Workers) != 2 {
+		t.Errorf("counts not summed: speed %d, generated %d, valid %d, workers %d", r.Speed, r.Generated, r.Validation["VALID"], len(r.Workers))
+	}
+	if len(r.Latency) != 1 {
+		t.Fatalf("expect 1 latency stage, got %d", len(r.Latency))
+	}
+	l := r.Latency[0]
+	if l.Count != 100 {
+		t.Errorf("expect 100 merged observations, got %d", l.Count)
+	}
+	// a的P99在第一个桶，b的在第四个桶，合并后90%在第一个桶，P50和P99分别落在两边
+	if l.P50 > 10 || l.P99 <= 50 || l.P99 > 100 {
+		t.Errorf("percentiles not recomputed from merged histogram: p50 %g, p99 %g", l.P50, l.P99)
+	}
+	if r.AchievedTPS != 10 {
+		t.Errorf("expect 10 tps over 10s, got %g", r.AchievedTPS)
+	}
+}
+
+// 相同阶段、节点和消息的错误只保留一条，次数相加，时间取最早和最晚
+func TestMergeReportsErrors(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeout := ErrorClass{Stage: "proposal", Endpoint: "peer0:7051", Code: "DeadlineExceeded", Message: "timeout", Count: 3, FirstSeen: t0.Add(time.Second), LastSeen: t0.Add(2 * time.Second)}
+	other := timeout
+	other.Count, other.FirstSeen, other.LastSeen = 4, t0, t0.Add(time.Second)
+	refused := ErrorClass{Stage: "broadcast", Endpoint: "orderer:7050", Message: "refused", Count: 1, FirstSeen: t0, LastSeen: t0}
+
+	r, err := MergeReports(&Config{}, []WorkerResult{workerResult("a", []float64{1}, timeout), workerResult("b", []float64{1}, other, refused)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Errors) != 2 {
+		t.Fatalf("expect 2 error classes, got %+v", r.Errors)
+	}
+	e := r.Errors[0]
+	if e.Message != "timeout" || e.Count != 7 || !e.FirstSeen.Equal(t0) || !e.LastSeen.Equal(t0.Add(2*time.Second)) {
+		t.Errorf("duplicated errors not merged: %+v", e)
+	}
+	if r.Errors[1].Message != "refused" || r.Errors[1].Count != 1 {
+		t.Errorf("unexpected second error class: %+v", r.Errors[1])
+	}
+}
+
+func TestMergeReportsBucketsMismatch(t *testing.T) {
+	a := workerResult("a", []float64{1})
+	b := workerResult("b", []float64{1})
+	b.Histograms["commit"] = NewHistogram([]float64{1, 2}).Snapshot()
+	if _, err := MergeReports(&Config{}, []WorkerResult{a, b}); err == nil {
+		t.Error("expect error for histograms with different buckets")
+	}
+}
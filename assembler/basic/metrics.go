@@ -0,0 +1,404 @@
+package basic
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// 导出给Prometheus的指标，文本格式参考：
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// LatencyBuckets 默认的时延桶，单位秒
+var LatencyBuckets = []float64{
+	.001, .002, .005, .01, .02, .03, .05, .075, .1, .15, .2, .3, .5, .75,
+	1, 1.5, 2, 3, 5, 7.5, 10, 15, 20, 30, 60, 120,
+}
+
+var GlobalMetrics = &Metrics{}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+type Metrics struct {
+	lock       sync.RWMutex
+	collectors []collector
+}
+
+func (m *Metrics) register(c collector) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.collectors = append(m.collectors, c)
+}
+
+func (m *Metrics) Write(w io.Writer) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, c := range m.collectors {
+		c.write(w)
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.Write(w)
+}
+
+// ServeMetrics 在addr上提供/metrics，阻塞直到出错
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", GlobalMetrics)
+	return http.ListenAndServe(addr, mux)
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.typ)
+}
+
+func labelPairs(names, values []string, extra ...string) string {
+	var pairs []string
+	for i, n := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", n, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+// vec 按标签值管理子指标，标签值在创建后不再变化，热路径上应缓存With的结果
+type vec struct {
+	desc
+	lock     sync.RWMutex
+	children map[string]interface{}
+	values   map[string][]string
+	create   func() interface{}
+}
+
+func (v *vec) with(values ...string) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.lock.RLock()
+	c, ok := v.children[key]
+	v.lock.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if c, ok = v.children[key]; ok {
+		return c
+	}
+	c = v.create()
+	v.children[key] = c
+	v.values[key] = values
+	return c
+}
+
+func (v *vec) each(f func(values []string, c interface{})) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		f(v.values[k], v.children[k])
+	}
+}
+
+func newVec(name, help, typ string, labels []string, create func() interface{}) vec {
+	return vec{
+		desc:     desc{name: name, help: help, typ: typ, labels: labels},
+		children: make(map[string]interface{}),
+		values:   make(map[string][]string),
+		create:   create,
+	}
+}
+
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Get() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+type CounterVec struct {
+	vec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{newVec(name, help, typeCounter, labels, func() interface{} { return &Counter{} })}
+	GlobalMetrics.register(cv)
+	return cv
+}
+
+func (cv *CounterVec) With(values ...string) *Counter {
+	return cv.with(values...).(*Counter)
+}
+
+func (cv *CounterVec) write(w io.Writer) {
+	cv.header(w)
+	cv.each(func(values []string, c interface{}) {
+		fmt.Fprintf(w, "%s%s %d\n", cv.name, labelPairs(cv.labels, values), c.(*Counter).Get())
+	})
+}
+
+type gaugeFunc struct {
+	f func() float64
+}
+
+// GaugeVec 中的gauge在采集时才求值
+type GaugeVec struct {
+	vec
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	gv := &GaugeVec{newVec(name, help, typeGauge, labels, func() interface{} { return &gaugeFunc{} })}
+	GlobalMetrics.register(gv)
+	return gv
+}
+
+// Set 指定标签值对应的取值函数
+func (gv *GaugeVec) Set(f func() float64, values ...string) {
+	g := gv.with(values...).(*gaugeFunc)
+	gv.lock.Lock()
+	g.f = f
+	gv.lock.Unlock()
+}
+
+func (gv *GaugeVec) write(w io.Writer) {
+	gv.header(w)
+	gv.each(func(values []string, c interface{}) {
+		if f := c.(*gaugeFunc).f; f != nil {
+			fmt.Fprintf(w, "%s%s %s\n", gv.name, labelPairs(gv.labels, values), formatFloat(f()))
+		}
+	})
+}
+
+type Histogram struct {
+	upper  []float64
+	counts []uint64
+	count  uint64
+	sum    uint64 // math.Float64bits
+	max    uint64 // math.Float64bits
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		upper:  buckets,
+		counts: make([]uint64, len(buckets)+1),
+	}
+}
+
+// Observe 记录一个样本，单位秒
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	addFloat(&h.sum, v)
+	maxFloat(&h.max, v)
+}
+
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sum))
+}
+
+func (h *Histogram) Max() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.max))
+}
+
+func (h *Histogram) Mean() float64 {
+	count := h.Count()
+	if count == 0 {
+		return 0
+	}
+	return h.Sum() / float64(count)
+}
+
+// Quantile 在桶内线性插值估算分位数，q取值[0,1]
+func (h *Histogram) Quantile(q float64) float64 {
+	counts := make([]uint64, len(h.counts))
+	var total uint64
+	for i := range h.counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+
+	max := h.Max()
+	rank := q * float64(total)
+	var cumulative uint64
+	for i, c := range counts {
+		if c == 0 || float64(cumulative+c) < rank {
+			cumulative += c
+			continue
+		}
+		lower, upper := 0.0, max
+		if i > 0 {
+			lower = h.upper[i-1]
+		}
+		if i < len(h.upper) && h.upper[i] < max {
+			upper = h.upper[i]
+		}
+		if upper < lower {
+			return max
+		}
+		return lower + (upper-lower)*(rank-float64(cumulative))/float64(c)
+	}
+	return max
+}
+
+// Merge 把src的样本累加进来，两者的桶必须相同
+func (h *Histogram) Merge(src *Histogram) {
+	for i := range src.counts {
+		atomic.AddUint64(&h.counts[i], atomic.LoadUint64(&src.counts[i]))
+	}
+	atomic.AddUint64(&h.count, src.Count())
+	addFloat(&h.sum, src.Sum())
+	maxFloat(&h.max, src.Max())
+}
+
+// HistogramSnapshot 可以序列化的直方图，用于在进程之间合并
+type HistogramSnapshot struct {
+	Upper  []float64 `json:"upper"`
+	Counts []uint64  `json:"counts"`
+	Count  uint64    `json:"count"`
+	Sum    float64   `json:"sum"`
+	Max    float64   `json:"max"`
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Upper:  h.upper,
+		Counts: make([]uint64, len(h.counts)),
+		Count:  h.Count(),
+		Sum:    h.Sum(),
+		Max:    h.Max(),
+	}
+	for i := range h.counts {
+		s.Counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	return s
+}
+
+// Histogram 还原成直方图，桶数不匹配时返回错误
+func (s HistogramSnapshot) Histogram() (*Histogram, error) {
+	if len(s.Counts) != len(s.Upper)+1 {
+		return nil, fmt.Errorf("histogram has %d buckets but %d counts", len(s.Upper), len(s.Counts))
+	}
+	h := NewHistogram(s.Upper)
+	copy(h.counts, s.Counts)
+	h.count = s.Count
+	h.sum = math.Float64bits(s.Sum)
+	h.max = math.Float64bits(s.Max)
+	return h, nil
+}
+
+func addFloat(addr *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		if atomic.CompareAndSwapUint64(addr, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func maxFloat(addr *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		if v <= math.Float64frombits(old) || atomic.CompareAndSwapUint64(addr, old, math.Float64bits(v)) {
+			return
+		}
+	}
+}
+
+type HistogramVec struct {
+	vec
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	hv := &HistogramVec{newVec(name, help, typeHistogram, labels, func() interface{} { return NewHistogram(buckets) })}
+	GlobalMetrics.register(hv)
+	return hv
+}
+
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	return hv.with(values...).(*Histogram)
+}
+
+// Merged 返回所有标签值合并后的直方图
+func (hv *HistogramVec) Merged() *Histogram {
+	merged := hv.create().(*Histogram)
+	hv.each(func(_ []string, c interface{}) {
+		merged.Merge(c.(*Histogram))
+	})
+	return merged
+}
+
+func (hv *HistogramVec) write(w io.Writer) {
+	hv.header(w)
+	hv.each(func(values []string, c interface{}) {
+		h := c.(*Histogram)
+		var cumulative uint64
+		for i := range h.counts {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			le := math.Inf(1)
+			if i < len(h.upper) {
+				le = h.upper[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, labelPairs(hv.labels, values, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", hv.name, labelPairs(hv.labels, values), formatFloat(h.Sum()))
+		fmt.Fprintf(w, "%s_count%s %d\n", hv.name, labelPairs(hv.labels, values), h.Count())
+	})
+}
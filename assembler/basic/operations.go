@@ -0,0 +1,475 @@
+package basic
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultOperationsInterval = 5 * time.Second
+
+// DefaultOperationsMetrics 未配置operations_metrics时抓取的peer和orderer指标，
+// 节点上不存在的指标会被忽略
+var DefaultOperationsMetrics = []string{
+	"endorser_proposal_duration",
+	"ledger_block_processing_time",
+	"ledger_blockstorage_commit_time",
+	"ledger_statedb_commit_time",
+	"ledger_transaction_count",
+	"ledger_blockchain_height",
+	"broadcast_validate_duration",
+	"broadcast_enqueue_duration",
+	"blockcutter_block_fill_duration",
+}
+
+// OperationsTarget 一个节点的运维端口，URL形如http://peer0:9443
+type OperationsTarget struct {
+	Node string
+	URL  string
+}
+
+// ServerMetric 某个节点上的一个指标，同名不同标签的序列相加。
+// histogram的Value为观察次数，Mean和P99是上次抓取以来的，单位和Fabric一致(秒)
+type ServerMetric struct {
+	Node   string  `json:"node"`
+	Metric string  `json:"metric"`
+	Type   string  `json:"type"`
+	Value  float64 `json:"value"`
+	Delta  float64 `json:"delta"`
+	Mean   float64 `json:"mean,omitempty"`
+	P99    float64 `json:"p99,omitempty"`
+}
+
+func (m *ServerMetric) Name() string {
+	return m.Node + "|" + m.Metric
+}
+
+// ServerReport 整个运行期间(第一次到最后一次抓取)某个节点上一个指标的变化
+type ServerReport struct {
+	Node   string  `json:"node"`
+	Metric string  `json:"metric"`
+	Type   string  `json:"type"`
+	Delta  float64 `json:"delta"` // counter的增量或histogram的观察次数
+	Last   float64 `json:"last"`
+	Max    float64 `json:"max"` // gauge的最大值
+	Mean   float64 `json:"mean,omitempty"`
+	P50    float64 `json:"p50,omitempty"`
+	P99    float64 `json:"p99,omitempty"`
+}
+
+// NodeHealth /healthz的最近一次结果
+type NodeHealth struct {
+	Node     string `json:"node"`
+	Status   string `json:"status"`
+	Failures int    `json:"failures"` // 检查失败的次数
+	Error    string `json:"error,omitempty"`
+}
+
+// family 一次抓取中一个指标合并后的值
+type family struct {
+	typ     string
+	value   float64 // counter和gauge
+	count   float64
+	sum     float64
+	buckets map[float64]float64 // le -> 累计次数
+}
+
+type scrape struct {
+	time     time.Time
+	families map[string]*family
+}
+
+// OperationsScraper 周期性地抓取Fabric节点的/metrics和/healthz
+type OperationsScraper struct {
+	targets []OperationsTarget
+	metrics []string
+	client  *http.Client
+
+	lock   sync.Mutex
+	time   time.Time
+	first  map[string]*scrape
+	last   map[string]*scrape
+	latest []ServerMetric
+	maxes  map[string]float64
+	health map[string]*NodeHealth
+}
+
+// NewOperationsScraper tlsCACerts用于https的运维端口
+func NewOperationsScraper(targets []OperationsTarget, metrics []string, tlsCACerts [][]byte) *OperationsScraper {
+	if len(metrics) == 0 {
+		metrics = DefaultOperationsMetrics
+	}
+	transport := http.DefaultTransport
+	if len(tlsCACerts) > 0 {
+		pool := x509.NewCertPool()
+		for _, c := range tlsCACerts {
+			pool.AppendCertsFromPEM(c)
+		}
+		transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+
+	s := &OperationsScraper{
+		targets: targets,
+		metrics: metrics,
+		client:  &http.Client{Timeout: 5 * time.Second, Transport: transport},
+		first:   make(map[string]*scrape),
+		last:    make(map[string]*scrape),
+		maxes:   make(map[string]float64),
+		health:  make(map[string]*NodeHealth),
+	}
+	for _, t := range targets {
+		s.health[t.Node] = &NodeHealth{Node: t.Node, Status: "unknown"}
+	}
+	s.latest = s.merge(nil)
+	return s
+}
+
+// Start 立即抓取一次，之后每隔interval抓取一次，直到ctx取消
+func (s *OperationsScraper) Start(ctx context.Context, interval time.Duration) {
+	s.Scrape()
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.Scrape()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Scrape 并发抓取所有节点，失败的节点保留上一次的值
+func (s *OperationsScraper) Scrape() {
+	now := time.Now()
+	results := make([]*scrape, len(s.targets))
+	healths := make([]NodeHealth, len(s.targets))
+	var wg sync.WaitGroup
+	for i := range s.targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			t := s.targets[i]
+			healths[i] = s.checkHealth(t)
+			families, err := s.fetch(t.URL + "/metrics")
+			if err != nil {
+				Logf("Failed to scrape %s: %s", t.Node, err)
+				return
+			}
+			results[i] = &scrape{time: now, families: families}
+		}(i)
+	}
+	wg.Wait()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, t := range s.targets {
+		h := s.health[t.Node]
+		h.Status, h.Error = healths[i].Status, healths[i].Error
+		if h.Status != "OK" {
+			h.Failures++
+		}
+	}
+	s.latest = s.merge(results)
+	s.time = now
+	for i, t := range s.targets {
+		if results[i] == nil {
+			continue
+		}
+		if s.first[t.Node] == nil {
+			s.first[t.Node] = results[i]
+		}
+		s.last[t.Node] = results[i]
+	}
+}
+
+// merge 计算本次抓取相对上一次的增量，调用时持有锁或者还未启动
+func (s *OperationsScraper) merge(results []*scrape) []ServerMetric {
+	var list []ServerMetric
+	for i, t := range s.targets {
+		for _, name := range s.metrics {
+			m := ServerMetric{Node: t.Node, Metric: name}
+			var cur, prev *family
+			if results != nil && results[i] != nil {
+				cur = results[i].families[name]
+			} else if last := s.last[t.Node]; last != nil {
+				cur = last.families[name] // 本次失败时沿用上一次，增量为0
+			}
+			if last := s.last[t.Node]; last != nil && results != nil && results[i] != nil {
+				// histogram在第一次观察之后才出现，之前视为0
+				if prev = last.families[name]; prev == nil {
+					prev = &family{}
+				}
+			}
+			if cur != nil {
+				m.Type = cur.typ
+				m.Value = cur.value
+				if cur.typ == "histogram" {
+					m.Value = cur.count
+				}
+				if prev != nil {
+					m.Delta = cur.value - prev.value
+					if cur.typ == "histogram" {
+						m.Delta = cur.count - prev.count
+					}
+					if cur.typ == "histogram" && m.Delta > 0 {
+						m.Mean = (cur.sum - prev.sum) / m.Delta
+						m.P99 = bucketQuantile(cur, prev, .99)
+					}
+				}
+				if cur.value > s.maxes[m.Name()] {
+					s.maxes[m.Name()] = cur.value
+				}
+			}
+			list = append(list, m)
+		}
+	}
+	return list
+}
+
+// Latest 返回最近一次抓取的时间和结果，节点和指标的顺序固定
+func (s *OperationsScraper) Latest() (time.Time, []ServerMetric) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.time, append([]ServerMetric(nil), s.latest...)
+}
+
+func (s *OperationsScraper) Health() []NodeHealth {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var list []NodeHealth
+	for _, t := range s.targets {
+		list = append(list, *s.health[t.Node])
+	}
+	return list
+}
+
+// Report 第一次到最后一次抓取之间的变化
+func (s *OperationsScraper) Report() []ServerReport {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var list []ServerReport
+	for _, t := range s.targets {
+		first, last := s.first[t.Node], s.last[t.Node]
+		if last == nil {
+			continue
+		}
+		for _, name := range s.metrics {
+			cur := last.families[name]
+			if cur == nil {
+				continue
+			}
+			prev := first.families[name]
+			if prev == nil {
+				prev = &family{typ: cur.typ}
+			}
+			r := ServerReport{Node: t.Node, Metric: name, Type: cur.typ, Last: cur.value, Max: s.maxes[t.Node+"|"+name]}
+			switch cur.typ {
+			case "histogram":
+				r.Last = cur.count
+				r.Delta = cur.count - prev.count
+				if r.Delta > 0 {
+					r.Mean = (cur.sum - prev.sum) / r.Delta
+					r.P50 = bucketQuantile(cur, prev, .5)
+					r.P99 = bucketQuantile(cur, prev, .99)
+				}
+			default:
+				r.Delta = cur.value - prev.value
+			}
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+func (s *OperationsScraper) checkHealth(t OperationsTarget) NodeHealth {
+	h := NodeHealth{Node: t.Node, Status: "OK"}
+	resp, err := s.client.Get(t.URL + "/healthz")
+	if err != nil {
+		h.Status, h.Error = "unreachable", err.Error()
+		return h
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		h.Status, h.Error = resp.Status, strings.TrimSpace(string(body))
+	}
+	return h
+}
+
+func (s *OperationsScraper) fetch(url string) (map[string]*family, error) {
+	resp, err := s.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return parseMetrics(resp.Body, s.metrics)
+}
+
+// parseMetrics 解析Prometheus文本格式，只保留names中的指标，并把不同标签的序列相加
+func parseMetrics(r io.Reader, names []string) (map[string]*family, error) {
+	wanted := make(map[string]bool, len(names))
+	for _, n := range names {
+		wanted[n] = true
+	}
+	types := make(map[string]string)
+	families := make(map[string]*family)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) == 4 && fields[1] == "TYPE" && wanted[fields[2]] {
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+
+		name, labels, value, err := parseSample(line)
+		if err != nil {
+			return nil, err
+		}
+		base, suffix := name, ""
+		for _, s := range []string{"_bucket", "_sum", "_count"} {
+			if b := strings.TrimSuffix(name, s); b != name && types[b] == "histogram" {
+				base, suffix = b, s
+				break
+			}
+		}
+		if !wanted[base] {
+			continue
+		}
+		f := families[base]
+		if f == nil {
+			f = &family{typ: types[base], buckets: make(map[float64]float64)}
+			if f.typ == "" {
+				f.typ = "untyped"
+			}
+			families[base] = f
+		}
+		switch suffix {
+		case "_bucket":
+			le, err := strconv.ParseFloat(labelValue(labels, "le"), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid bucket in %q", line)
+			}
+			f.buckets[le] += value
+		case "_sum":
+			f.sum += value
+		case "_count":
+			f.count += value
+		default:
+			f.value += value
+		}
+	}
+	return families, scanner.Err()
+}
+
+// parseSample 解析name{labels} value [timestamp]
+func parseSample(line string) (string, string, float64, error) {
+	var name, labels, rest string
+	if i := strings.IndexByte(line, '{'); i >= 0 {
+		j := closingBrace(line, i)
+		if j < 0 {
+			return "", "", 0, fmt.Errorf("invalid metric line %q", line)
+		}
+		name, labels, rest = line[:i], line[i+1:j], line[j+1:]
+	} else {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return "", "", 0, fmt.Errorf("invalid metric line %q", line)
+		}
+		name, rest = fields[0], strings.Join(fields[1:], " ")
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return "", "", 0, fmt.Errorf("invalid metric line %q", line)
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("invalid value in %q", line)
+	}
+	return name, labels, v, nil
+}
+
+// closingBrace 跳过引号中的内容找到匹配的}
+func closingBrace(line string, open int) int {
+	quoted := false
+	for i := open + 1; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case '}':
+			if !quoted {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func labelValue(labels, name string) string {
+	for _, pair := range strings.Split(labels, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 && kv[0] == name {
+			return strings.Trim(kv[1], `"`)
+		}
+	}
+	return ""
+}
+
+// bucketQuantile 用两次抓取之间各桶的增量估算分位数，桶内线性插值
+func bucketQuantile(cur, prev *family, q float64) float64 {
+	les := make([]float64, 0, len(cur.buckets))
+	for le := range cur.buckets {
+		les = append(les, le)
+	}
+	sort.Float64s(les)
+	if len(les) == 0 {
+		return 0
+	}
+
+	total := cur.buckets[les[len(les)-1]] - prev.buckets[les[len(les)-1]]
+	if total <= 0 {
+		return 0
+	}
+	rank := q * total
+	lower, below := 0.0, 0.0
+	for _, le := range les {
+		n := cur.buckets[le] - prev.buckets[le]
+		if n >= rank {
+			if math.IsInf(le, 1) {
+				return lower // 超出最大的桶，只能给出下界
+			}
+			if n == below {
+				return le
+			}
+			return lower + (le-lower)*(rank-below)/(n-below)
+		}
+		lower, below = le, n
+	}
+	return lower
+}
@@ -0,0 +1,157 @@
+package basic
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakePeer 模拟peer的运维端口，每次抓取之间由测试推进
+type fakePeer struct {
+	round int32
+}
+
+func (p *fakePeer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/healthz":
+		w.Write([]byte(`{"status":"OK"}`))
+	case "/metrics":
+		n := atomic.LoadInt32(&p.round)
+		fmt.Fprintf(w, `# HELP endorser_proposal_duration The time to complete a proposal.
+# TYPE endorser_proposal_duration histogram
+endorser_proposal_duration_bucket{channel="mychannel",chaincode="mycc:1.0",success="true",le="0.01"} %d
+endorser_proposal_duration_bucket{channel="mychannel",chaincode="mycc:1.0",success="true",le="0.1"} %d
+endorser_proposal_duration_bucket{channel="mychannel",chaincode="mycc:1.0",success="true",le="+Inf"} %d
+endorser_proposal_duration_sum{channel="mychannel",chaincode="mycc:1.0",success="true"} %g
+endorser_proposal_duration_count{channel="mychannel",chaincode="mycc:1.0",success="true"} %d
+# HELP ledger_transaction_count Number of transactions processed.
+# TYPE ledger_transaction_count counter
+ledger_transaction_count{channel="mychannel",validation_code="VALID"} %d
+ledger_transaction_count{channel="mychannel",validation_code="MVCC_READ_CONFLICT"} %d
+# HELP ledger_blockchain_height Height of the chain in blocks.
+# TYPE ledger_blockchain_height gauge
+ledger_blockchain_height{channel="mychannel"} %d
+# HELP go_goroutines Number of goroutines.
+# TYPE go_goroutines gauge
+go_goroutines 42
+`, 50*n, 100*n, 100*n, 2.5*float64(n), 100*n, 90*n, 10*n, 5+n)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestOperationsScraper(t *testing.T) {
+	peer := &fakePeer{}
+	server := httptest.NewServer(peer)
+	defer server.Close()
+
+	s := NewOperationsScraper([]OperationsTarget{{Node: "peer0:7051", URL: server.URL}},
+		[]string{"endorser_proposal_duration", "ledger_transaction_count", "ledger_blockchain_height"}, nil)
+	s.Scrape()
+	atomic.StoreInt32(&peer.round, 1)
+	s.Scrape()
+	atomic.StoreInt32(&peer.round, 3)
+	s.Scrape()
+
+	_, latest := s.Latest()
+	if len(latest) != 3 {
+		t.Fatalf("expected 3 metrics, got %d", len(latest))
+	}
+	proposal := latest[0]
+	if proposal.Type != "histogram" || proposal.Value != 300 || proposal.Delta != 200 {
+		t.Fatalf("unexpected proposal duration %+v", proposal)
+	}
+	if math.Abs(proposal.Mean-0.025) > 1e-9 {
+		t.Fatalf("expected mean 0.025, got %g", proposal.Mean)
+	}
+	if proposal.P99 <= 0.01 || proposal.P99 > 0.1 {
+		t.Fatalf("expected p99 within (0.01, 0.1], got %g", proposal.P99)
+	}
+	if tx := latest[1]; tx.Type != "counter" || tx.Value != 300 || tx.Delta != 200 {
+		t.Fatalf("unexpected transaction count %+v", tx)
+	}
+	if height := latest[2]; height.Type != "gauge" || height.Value != 8 || height.Delta != 2 {
+		t.Fatalf("unexpected blockchain height %+v", height)
+	}
+
+	report := s.Report()
+	if len(report) != 3 {
+		t.Fatalf("expected 3 metrics in report, got %d", len(report))
+	}
+	if r := report[0]; r.Delta != 300 || math.Abs(r.Mean-0.025) > 1e-9 || r.P50 > 0.01 {
+		t.Fatalf("unexpected proposal duration report %+v", r)
+	}
+	if r := report[2]; r.Delta != 3 || r.Max != 8 {
+		t.Fatalf("unexpected blockchain height report %+v", r)
+	}
+
+	health := s.Health()
+	if len(health) != 1 || health[0].Status != "OK" || health[0].Failures != 0 {
+		t.Fatalf("unexpected health %+v", health)
+	}
+}
+
+// ctx取消后不再抓取
+func TestOperationsScraperStop(t *testing.T) {
+	var scrapes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			atomic.AddInt32(&scrapes, 1)
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewOperationsScraper([]OperationsTarget{{Node: "peer0:7051", URL: server.URL}}, nil, nil)
+	s.Start(ctx, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	// 等待取消时正在进行的一次抓取结束
+	time.Sleep(20 * time.Millisecond)
+	n := atomic.LoadInt32(&scrapes)
+	if n < 2 {
+		t.Fatalf("expected periodic scrapes before cancel, got %d", n)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if m := atomic.LoadInt32(&scrapes); m != n {
+		t.Fatalf("scraped %d more times after cancel", m-n)
+	}
+}
+
+func TestOperationsScraperUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	s := NewOperationsScraper([]OperationsTarget{{Node: "orderer:7050", URL: server.URL}}, nil, nil)
+	s.Scrape()
+	if h := s.Health(); h[0].Status != "unreachable" || h[0].Failures != 1 {
+		t.Fatalf("unexpected health %+v", h)
+	}
+	if r := s.Report(); len(r) != 0 {
+		t.Fatalf("expected empty report, got %+v", r)
+	}
+	_, latest := s.Latest()
+	if len(latest) != len(DefaultOperationsMetrics) {
+		t.Fatalf("expected %d metrics, got %d", len(DefaultOperationsMetrics), len(latest))
+	}
+}
+
+func TestParseMetricsQuotedLabels(t *testing.T) {
+	text := `# TYPE ledger_transaction_count counter
+ledger_transaction_count{chaincode="a}b",channel="c"} 3 1600000000000
+ledger_transaction_count{chaincode="d",channel="c"} 4
+`
+	families, err := parseMetrics(strings.NewReader(text), []string{"ledger_transaction_count"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := families["ledger_transaction_count"]; f == nil || f.value != 7 {
+		t.Fatalf("unexpected family %+v", f)
+	}
+}
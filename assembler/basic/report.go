@@ -0,0 +1,489 @@
+package basic
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	FormatJSON     = "json"
+	FormatCSV      = "csv"
+	FormatMarkdown = "md"
+)
+
+// Report 测试结束后的汇总报告
+type Report struct {
+	Config      *Config           `json:"config"`
+	Speed       uint              `json:"speed"`
+	Total       uint64            `json:"total"`
+	StartTime   time.Time         `json:"start_time"`
+	EndTime     time.Time         `json:"end_time"`
+	Duration    float64           `json:"duration_seconds"`
+	Generated   uint64            `json:"generated"`
+	Committed   uint64            `json:"committed"`
+	Unconfirmed uint64            `json:"unconfirmed"` // 结束时既没有上链也没有失败的交易
+	OfferedTPS  float64           `json:"offered_tps"`
+	AchievedTPS float64           `json:"achieved_tps"`
+	Stages      []StageReport     `json:"stages"`
+	Validation  map[string]uint64 `json:"validation_codes"`
+	Latency     []LatencyReport   `json:"latency"`
+	PeakQueues  map[string]int    `json:"peak_queues"`
+	Endpoints   []EndpointReport  `json:"endpoints"`
+	Connections []EndpointReport  `json:"connections"`
+	Errors      []ErrorClass      `json:"errors"`
+	Client      ClientReport      `json:"client"`
+	Server      []ServerReport    `json:"server,omitempty"`
+	Health      []NodeHealth      `json:"health,omitempty"`
+	Workers     []WorkerSummary   `json:"workers,omitempty"`         // 只有分布式压测的合并报告才有
+	Missing     []string          `json:"missing_workers,omitempty"` // 没有交回报告的worker，不在合并结果中
+	Resubmit    *ResubmitReport   `json:"resubmit,omitempty"`        // 只有配置了resubmit才有
+	Adaptive    *AdaptiveReport   `json:"adaptive_rate,omitempty"`
+}
+
+// AdaptiveReport 自适应速度的调整结果，合并报告中速度为各worker之和
+type AdaptiveReport struct {
+	Mode      string  `json:"mode"`
+	Initial   uint    `json:"initial_rate"`
+	Final     uint    `json:"final_rate"`
+	Settled   float64 `json:"settled_rate"` // 最后10次调整后速度的平均
+	Lowest    uint    `json:"lowest_rate"`
+	Increases uint64  `json:"increases"`
+	Decreases uint64  `json:"decreases"`
+}
+
+// ResubmitReport 验证失效后重做操作的统计，Generated是操作数，Committed包括每次提交
+type ResubmitReport struct {
+	MaxAttempts int            `json:"max_attempts"`
+	Resubmitted uint64         `json:"resubmitted"`          // 重做时新建的交易数
+	Attempts    map[int]uint64 `json:"attempts_per_success"` // 成功的操作按提交次数的分布
+	GaveUp      uint64         `json:"gave_up"`              // 提交了MaxAttempts次仍然失效的操作
+	Latency     LatencyReport  `json:"latency"`              // 从第一次创建提案到成功上链，包括重做
+}
+
+// sortedAttempts 按提交次数从小到大
+func (r *ResubmitReport) sortedAttempts() []int {
+	keys := make([]int, 0, len(r.Attempts))
+	for k := range r.Attempts {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// StageReport Total为尝试次数，Fail为最终失败，Retried为失败后又重试的尝试
+type StageReport struct {
+	Stage   string `json:"stage"`
+	Total   uint64 `json:"total"`
+	Success uint64 `json:"success"`
+	Fail    uint64 `json:"fail"`
+	Retried uint64 `json:"retried"`
+}
+
+// EndpointReport 某个节点或者某个gRPC连接上的统计，节点汇总时Conn为-1
+type EndpointReport struct {
+	Stage    string        `json:"stage"`
+	Endpoint string        `json:"endpoint"`
+	Conn     int           `json:"conn"`
+	Total    uint64        `json:"total"`
+	Success  uint64        `json:"success"`
+	Fail     uint64        `json:"fail"`
+	Retried  uint64        `json:"retried"`
+	Routed   uint64        `json:"routed"` // Dispatcher分到的交易数，不包括重试
+	Latency  LatencyReport `json:"latency"`
+
+	// broadcast流断开重连的次数，以及重连后重发和计为丢失的交易数
+	Reconnects uint64 `json:"reconnects,omitempty"`
+	Resent     uint64 `json:"resent,omitempty"`
+	Lost       uint64 `json:"lost,omitempty"`
+}
+
+// Name 节点地址，连接统计时附加#连接序号
+func (e *EndpointReport) Name() string {
+	if e.Conn < 0 {
+		return e.Endpoint
+	}
+	return fmt.Sprintf("%s#%d", e.Endpoint, e.Conn)
+}
+
+// RoutedShares 每个节点或连接分到的交易占同一阶段的比例
+func RoutedShares(list []EndpointReport) []float64 {
+	totals := make(map[string]uint64)
+	for _, e := range list {
+		totals[e.Stage] += e.Routed
+	}
+	shares := make([]float64, len(list))
+	for i, e := range list {
+		if t := totals[e.Stage]; t > 0 {
+			shares[i] = float64(e.Routed) / float64(t)
+		}
+	}
+	return shares
+}
+
+// LatencyReport 时延统计，单位秒
+type LatencyReport struct {
+	Stage string  `json:"stage"`
+	Count uint64  `json:"count"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+	P999  float64 `json:"p999"`
+	Max   float64 `json:"max"`
+}
+
+func NewLatencyReport(stage string, h *Histogram) LatencyReport {
+	return LatencyReport{
+		Stage: stage,
+		Count: h.Count(),
+		Mean:  h.Mean(),
+		P50:   h.Quantile(.5),
+		P90:   h.Quantile(.9),
+		P95:   h.Quantile(.95),
+		P99:   h.Quantile(.99),
+		P999:  h.Quantile(.999),
+		Max:   h.Max(),
+	}
+}
+
+func LoadReport(f string) (*Report, error) {
+	raw, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Report{}
+	if err = json.Unmarshal(raw, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Save 按formats把报告写到path，不同格式替换path的扩展名
+func (r *Report) Save(path string, formats []string) error {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	for _, format := range formats {
+		var write func(io.Writer) error
+		switch format {
+		case FormatJSON:
+			write = r.WriteJSON
+		case FormatCSV:
+			write = r.WriteCSV
+		case FormatMarkdown:
+			write = r.WriteMarkdown
+		default:
+			return fmt.Errorf("unknown report format %s", format)
+		}
+
+		f, err := os.Create(base + "." + format)
+		if err != nil {
+			return err
+		}
+		err = write(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteCSV 以section,name,key,value的形式逐行输出，便于导入表格
+func (r *Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"section", "name", "key", "value"})
+	for _, row := range r.rows() {
+		_ = cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (r *Report) WriteMarkdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Stupid run report\n\n")
+	fmt.Fprintf(&b, "| Item | Value |\n|---|---|\n")
+	for _, row := range r.rows() {
+		if row[0] == "run" {
+			fmt.Fprintf(&b, "| %s | %s |\n", row[2], row[3])
+		}
+	}
+
+	fmt.Fprintf(&b, "\n## Stages\n\n| Stage | Total | Success | Fail | Retried |\n|---|---:|---:|---:|---:|\n")
+	for _, s := range r.Stages {
+		fmt.Fprintf(&b, "| %s | %d | %d | %d | %d |\n", s.Stage, s.Total, s.Success, s.Fail, s.Retried)
+	}
+
+	if len(r.Workers) > 0 {
+		fmt.Fprintf(&b, "\n## Workers\n\n| Worker | Speed | Total | Generated | Committed | Achieved TPS | Saturated |\n|---|---:|---:|---:|---:|---:|---|\n")
+		for _, w := range r.Workers {
+			fmt.Fprintf(&b, "| %s | %d | %d | %d | %d | %.2f | %t |\n", w.Worker, w.Speed, w.Total, w.Generated, w.Committed, w.AchievedTPS, w.Saturated)
+		}
+		if len(r.Missing) > 0 {
+			fmt.Fprintf(&b, "\nMissing workers, not included above: %s\n", strings.Join(r.Missing, ", "))
+		}
+	}
+
+	fmt.Fprintf(&b, "\n## Latency (ms)\n\n| Stage | Count | Mean | P50 | P90 | P95 | P99 | P99.9 | Max |\n|---|---:|---:|---:|---:|---:|---:|---:|---:|\n")
+	for _, l := range r.Latency {
+		fmt.Fprintf(&b, "| %s | %d | %.1f | %.1f | %.1f | %.1f | %.1f | %.1f | %.1f |\n",
+			l.Stage, l.Count, l.Mean*1e3, l.P50*1e3, l.P90*1e3, l.P95*1e3, l.P99*1e3, l.P999*1e3, l.Max*1e3)
+	}
+
+	for _, section := range []struct {
+		title string
+		list  []EndpointReport
+	}{{"Endpoints", r.Endpoints}, {"Connections", r.Connections}} {
+		fmt.Fprintf(&b, "\n## %s\n\n| Stage | Endpoint | Routed | Share | Total | Success | Fail | Retried | Mean (ms) | P99 (ms) | Reconnects | Resent | Lost |\n|---|---|---:|---:|---:|---:|---:|---:|---:|---:|---:|---:|---:|\n", section.title)
+		shares := RoutedShares(section.list)
+		for i, e := range section.list {
+			fmt.Fprintf(&b, "| %s | %s | %d | %.1f%% | %d | %d | %d | %d | %.1f | %.1f | %d | %d | %d |\n",
+				e.Stage, e.Name(), e.Routed, shares[i]*100, e.Total, e.Success, e.Fail, e.Retried, e.Latency.Mean*1e3, e.Latency.P99*1e3, e.Reconnects, e.Resent, e.Lost)
+		}
+	}
+
+	fmt.Fprintf(&b, "\n## Errors\n\n| Count | Stage | Endpoint | gRPC code | Status | First seen | Last seen | Message |\n|---:|---|---|---|---:|---|---|---|\n")
+	for _, e := range r.Errors {
+		fmt.Fprintf(&b, "| %d | %s | %s | %s | %d | %s | %s | %s |\n", e.Count, e.Stage, e.Endpoint, e.Code, e.Status,
+			e.FirstSeen.Format(time.RFC3339), e.LastSeen.Format(time.RFC3339), strings.Replace(e.Message, "|", "\\|", -1))
+	}
+
+	fmt.Fprintf(&b, "\n## Validation codes\n\n| Code | Count |\n|---|---:|\n")
+	for _, code := range sortedKeys(r.Validation) {
+		fmt.Fprintf(&b, "| %s | %d |\n", code, r.Validation[code])
+	}
+
+	if ad := r.Adaptive; ad != nil {
+		fmt.Fprintf(&b, "\n## Adaptive rate\n\n| Item | Value |\n|---|---|\n| Mode | %s |\n| Initial rate | %d |\n| Settled rate | %.1f |\n| Final rate | %d |\n| Lowest rate | %d |\n| Increases | %d |\n| Decreases | %d |\n",
+			ad.Mode, ad.Initial, ad.Settled, ad.Final, ad.Lowest, ad.Increases, ad.Decreases)
+	}
+
+	if rs := r.Resubmit; rs != nil {
+		fmt.Fprintf(&b, "\n## Resubmission\n\nUp to %d attempts per operation, %d transactions resubmitted, %d operations gave up.\n\n| Attempts | Succeeded operations |\n|---:|---:|\n",
+			rs.MaxAttempts, rs.Resubmitted, rs.GaveUp)
+		for _, n := range rs.sortedAttempts() {
+			fmt.Fprintf(&b, "| %d | %d |\n", n, rs.Attempts[n])
+		}
+		l := rs.Latency
+		fmt.Fprintf(&b, "\nLatency including resubmissions (ms): mean %.1f, P50 %.1f, P99 %.1f, max %.1f\n",
+			l.Mean*1e3, l.P50*1e3, l.P99*1e3, l.Max*1e3)
+	}
+
+	c := r.Client
+	fmt.Fprintf(&b, "\n## Client\n\n")
+	if c.Saturated() {
+		fmt.Fprintf(&b, "**WARNING: the generator was saturated in %d of %d samples, results may be limited by the client.**\n\n",
+			c.SaturatedSamples, c.Samples)
+	}
+	fmt.Fprintf(&b, "| Item | Value |\n|---|---|\n| Peak CPU | %.1f%% |\n| Peak goroutines | %d |\n| Peak heap (MB) | %.1f |\n| GC | %d |\n| Max GC pause (ms) | %.1f |\n| Saturated samples | %d/%d |\n",
+		c.PeakCPU*100, c.PeakGoroutines, float64(c.PeakHeapBytes)/(1<<20), c.NumGC, c.GCPauseMax*1e3, c.SaturatedSamples, c.Samples)
+	for _, name := range sortedFloatKeys(c.PeakChannels) {
+		fmt.Fprintf(&b, "| Peak fill of %s | %.0f%% |\n", name, c.PeakChannels[name]*100)
+	}
+
+	if len(r.Server) > 0 {
+		fmt.Fprintf(&b, "\n## Server metrics\n\n| Node | Metric | Type | Delta | Last | Max | Mean (ms) | P50 (ms) | P99 (ms) |\n|---|---|---|---:|---:|---:|---:|---:|---:|\n")
+		for _, m := range r.Server {
+			fmt.Fprintf(&b, "| %s | %s | %s | %g | %g | %g | %.1f | %.1f | %.1f |\n",
+				m.Node, m.Metric, m.Type, m.Delta, m.Last, m.Max, m.Mean*1e3, m.P50*1e3, m.P99*1e3)
+		}
+	}
+	if len(r.Health) > 0 {
+		fmt.Fprintf(&b, "\n## Node health\n\n| Node | Status | Failed checks | Error |\n|---|---|---:|---|\n")
+		for _, h := range r.Health {
+			fmt.Fprintf(&b, "| %s | %s | %d | %s |\n", h.Node, h.Status, h.Failures, strings.Replace(h.Error, "|", "\\|", -1))
+		}
+	}
+
+	fmt.Fprintf(&b, "\n## Peak queue depths\n\n| Queue | Depth |\n|---|---:|\n")
+	for _, q := range r.queueNames() {
+		fmt.Fprintf(&b, "| %s | %d |\n", q, r.PeakQueues[q])
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (r *Report) rows() [][]string {
+	rows := [][]string{
+		{"run", "", "start_time", r.StartTime.Format(time.RFC3339Nano)},
+		{"run", "", "end_time", r.EndTime.Format(time.RFC3339Nano)},
+		{"run", "", "duration_seconds", fmt.Sprintf("%.3f", r.Duration)},
+		{"run", "", "speed", fmt.Sprintf("%d", r.Speed)},
+		{"run", "", "total", fmt.Sprintf("%d", r.Total)},
+		{"run", "", "generated", fmt.Sprintf("%d", r.Generated)},
+		{"run", "", "committed", fmt.Sprintf("%d", r.Committed)},
+		{"run", "", "unconfirmed", fmt.Sprintf("%d", r.Unconfirmed)},
+		{"run", "", "offered_tps", fmt.Sprintf("%.2f", r.OfferedTPS)},
+		{"run", "", "achieved_tps", fmt.Sprintf("%.2f", r.AchievedTPS)},
+	}
+	if r.Config != nil {
+		rows = append(rows,
+			[]string{"run", "", "channel", r.Config.Channel},
+			[]string{"run", "", "chaincode", r.Config.Chaincode},
+			[]string{"run", "", "num_of_conn", fmt.Sprintf("%d", r.Config.NumOfConn)},
+			[]string{"run", "", "client_per_conn", fmt.Sprintf("%d", r.Config.ClientPerConn)},
+		)
+	}
+	for _, s := range r.Stages {
+		rows = append(rows,
+			[]string{"stage", s.Stage, "total", fmt.Sprintf("%d", s.Total)},
+			[]string{"stage", s.Stage, "success", fmt.Sprintf("%d", s.Success)},
+			[]string{"stage", s.Stage, "fail", fmt.Sprintf("%d", s.Fail)},
+			[]string{"stage", s.Stage, "retried", fmt.Sprintf("%d", s.Retried)},
+		)
+	}
+	for _, w := range r.Workers {
+		rows = append(rows,
+			[]string{"worker", w.Worker, "speed", fmt.Sprintf("%d", w.Speed)},
+			[]string{"worker", w.Worker, "total", fmt.Sprintf("%d", w.Total)},
+			[]string{"worker", w.Worker, "generated", fmt.Sprintf("%d", w.Generated)},
+			[]string{"worker", w.Worker, "committed", fmt.Sprintf("%d", w.Committed)},
+			[]string{"worker", w.Worker, "achieved_tps", fmt.Sprintf("%.2f", w.AchievedTPS)},
+			[]string{"worker", w.Worker, "saturated", fmt.Sprintf("%t", w.Saturated)},
+		)
+	}
+	for _, w := range r.Missing {
+		rows = append(rows, []string{"worker", w, "missing", "true"})
+	}
+	for _, code := range sortedKeys(r.Validation) {
+		rows = append(rows, []string{"validation", code, "count", fmt.Sprintf("%d", r.Validation[code])})
+	}
+	if ad := r.Adaptive; ad != nil {
+		rows = append(rows,
+			[]string{"adaptive", ad.Mode, "initial_rate", fmt.Sprintf("%d", ad.Initial)},
+			[]string{"adaptive", ad.Mode, "settled_rate", fmt.Sprintf("%.1f", ad.Settled)},
+			[]string{"adaptive", ad.Mode, "final_rate", fmt.Sprintf("%d", ad.Final)},
+			[]string{"adaptive", ad.Mode, "lowest_rate", fmt.Sprintf("%d", ad.Lowest)},
+			[]string{"adaptive", ad.Mode, "increases", fmt.Sprintf("%d", ad.Increases)},
+			[]string{"adaptive", ad.Mode, "decreases", fmt.Sprintf("%d", ad.Decreases)},
+		)
+	}
+	if rs := r.Resubmit; rs != nil {
+		rows = append(rows,
+			[]string{"resubmit", "", "resubmitted", fmt.Sprintf("%d", rs.Resubmitted)},
+			[]string{"resubmit", "", "gave_up", fmt.Sprintf("%d", rs.GaveUp)},
+			[]string{"resubmit", "", "latency_mean", fmt.Sprintf("%.6f", rs.Latency.Mean)},
+			[]string{"resubmit", "", "latency_p99", fmt.Sprintf("%.6f", rs.Latency.P99)},
+		)
+		for _, n := range rs.sortedAttempts() {
+			rows = append(rows, []string{"resubmit", fmt.Sprintf("%d", n), "succeeded", fmt.Sprintf("%d", rs.Attempts[n])})
+		}
+	}
+	for _, l := range r.Latency {
+		for _, kv := range []struct {
+			k string
+			v float64
+		}{{"mean", l.Mean}, {"p50", l.P50}, {"p90", l.P90}, {"p95", l.P95}, {"p99", l.P99}, {"p999", l.P999}, {"max", l.Max}} {
+			rows = append(rows, []string{"latency", l.Stage, kv.k, fmt.Sprintf("%.6f", kv.v)})
+		}
+		rows = append(rows, []string{"latency", l.Stage, "count", fmt.Sprintf("%d", l.Count)})
+	}
+	for _, q := range r.queueNames() {
+		rows = append(rows, []string{"peak_queue", q, "depth", fmt.Sprintf("%d", r.PeakQueues[q])})
+	}
+	for _, section := range []struct {
+		name string
+		list []EndpointReport
+	}{{"endpoint", r.Endpoints}, {"connection", r.Connections}} {
+		for _, e := range section.list {
+			name := e.Stage + "@" + e.Name()
+			rows = append(rows,
+				[]string{section.name, name, "routed", fmt.Sprintf("%d", e.Routed)},
+				[]string{section.name, name, "total", fmt.Sprintf("%d", e.Total)},
+				[]string{section.name, name, "success", fmt.Sprintf("%d", e.Success)},
+				[]string{section.name, name, "fail", fmt.Sprintf("%d", e.Fail)},
+				[]string{section.name, name, "retried", fmt.Sprintf("%d", e.Retried)},
+				[]string{section.name, name, "latency_mean", fmt.Sprintf("%.6f", e.Latency.Mean)},
+				[]string{section.name, name, "latency_p50", fmt.Sprintf("%.6f", e.Latency.P50)},
+				[]string{section.name, name, "latency_p99", fmt.Sprintf("%.6f", e.Latency.P99)},
+				[]string{section.name, name, "reconnects", fmt.Sprintf("%d", e.Reconnects)},
+				[]string{section.name, name, "resent", fmt.Sprintf("%d", e.Resent)},
+				[]string{section.name, name, "lost", fmt.Sprintf("%d", e.Lost)},
+			)
+		}
+	}
+	c := r.Client
+	rows = append(rows,
+		[]string{"client", "", "samples", fmt.Sprintf("%d", c.Samples)},
+		[]string{"client", "", "saturated_samples", fmt.Sprintf("%d", c.SaturatedSamples)},
+		[]string{"client", "", "peak_cpu", fmt.Sprintf("%.3f", c.PeakCPU)},
+		[]string{"client", "", "peak_goroutines", fmt.Sprintf("%d", c.PeakGoroutines)},
+		[]string{"client", "", "peak_heap_bytes", fmt.Sprintf("%d", c.PeakHeapBytes)},
+		[]string{"client", "", "num_gc", fmt.Sprintf("%d", c.NumGC)},
+		[]string{"client", "", "gc_pause_max_seconds", fmt.Sprintf("%.6f", c.GCPauseMax)},
+		[]string{"client", "", "gc_pause_total_seconds", fmt.Sprintf("%.6f", c.GCPauseTotal)},
+	)
+	for _, name := range sortedFloatKeys(c.PeakChannels) {
+		rows = append(rows, []string{"client", name, "peak_fill", fmt.Sprintf("%.3f", c.PeakChannels[name])})
+	}
+	for _, m := range r.Server {
+		name := m.Node + "|" + m.Metric
+		rows = append(rows,
+			[]string{"server", name, "type", m.Type},
+			[]string{"server", name, "delta", fmt.Sprintf("%g", m.Delta)},
+			[]string{"server", name, "last", fmt.Sprintf("%g", m.Last)},
+			[]string{"server", name, "max", fmt.Sprintf("%g", m.Max)},
+			[]string{"server", name, "mean", fmt.Sprintf("%.6f", m.Mean)},
+			[]string{"server", name, "p50", fmt.Sprintf("%.6f", m.P50)},
+			[]string{"server", name, "p99", fmt.Sprintf("%.6f", m.P99)},
+		)
+	}
+	for _, h := range r.Health {
+		rows = append(rows,
+			[]string{"health", h.Node, "status", h.Status},
+			[]string{"health", h.Node, "failures", fmt.Sprintf("%d", h.Failures)},
+		)
+	}
+	for i, e := range r.Errors {
+		name := fmt.Sprintf("%d", i+1)
+		rows = append(rows,
+			[]string{"error", name, "stage", e.Stage},
+			[]string{"error", name, "endpoint", e.Endpoint},
+			[]string{"error", name, "grpc_code", e.Code},
+			[]string{"error", name, "status", fmt.Sprintf("%d", e.Status)},
+			[]string{"error", name, "message", e.Message},
+			[]string{"error", name, "count", fmt.Sprintf("%d", e.Count)},
+			[]string{"error", name, "first_seen", e.FirstSeen.Format(time.RFC3339Nano)},
+			[]string{"error", name, "last_seen", e.LastSeen.Format(time.RFC3339Nano)},
+		)
+	}
+	return rows
+}
+
+func (r *Report) queueNames() []string {
+	return sortedQueues(r.PeakQueues)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedFloatKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,80 @@
+package basic
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/protos/common"
+	"google.golang.org/grpc/status"
+)
+
+// RetryConfig 一个阶段的重试策略，没有配置时不重试
+type RetryConfig struct {
+	MaxAttempts int      `json:"max_attempts"` // 包括第一次在内的最多尝试次数
+	Backoff     string   `json:"backoff"`      // 每次重试前等待的时间，默认100ms
+	Codes       []string `json:"codes"`        // 重试的gRPC状态码，如Unavailable、DeadlineExceeded
+	Statuses    []string `json:"statuses"`     // 重试的Fabric状态，名字或数字，如SERVICE_UNAVAILABLE、500
+}
+
+// RetryPolicy 解析后的重试策略，nil表示不重试
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	codes       map[string]bool
+	statuses    map[string]bool
+}
+
+// Policy MaxAttempts不超过1时返回nil
+func (c RetryConfig) Policy() (*RetryPolicy, error) {
+	if c.MaxAttempts < 0 {
+		return nil, fmt.Errorf("max_attempts must not be negative, got %d", c.MaxAttempts)
+	}
+	if c.MaxAttempts <= 1 {
+		return nil, nil
+	}
+	p := &RetryPolicy{
+		MaxAttempts: c.MaxAttempts,
+		Backoff:     100 * time.Millisecond,
+		codes:       make(map[string]bool),
+		statuses:    make(map[string]bool),
+	}
+	if c.Backoff != "" {
+		d, err := time.ParseDuration(c.Backoff)
+		if err != nil {
+			return nil, err
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("backoff must not be negative, got %s", c.Backoff)
+		}
+		p.Backoff = d
+	}
+	for _, code := range c.Codes {
+		p.codes[code] = true
+	}
+	for _, s := range c.Statuses {
+		p.statuses[s] = true
+		// 背书应答只有数字状态，名字同时登记为对应的数字
+		if v, ok := common.Status_value[s]; ok {
+			p.statuses[strconv.Itoa(int(v))] = true
+		}
+	}
+	return p, nil
+}
+
+// RetryError 第attempt次尝试(从1开始)因为err失败后是否重试，按gRPC状态码判断
+func (p *RetryPolicy) RetryError(attempt int, err error) bool {
+	if p == nil || attempt >= p.MaxAttempts {
+		return false
+	}
+	s, ok := status.FromError(err)
+	return ok && p.codes[s.Code().String()]
+}
+
+// RetryStatus 第attempt次尝试返回非成功状态后是否重试，name为状态的名字，可以为空
+func (p *RetryPolicy) RetryStatus(attempt int, code int32, name string) bool {
+	if p == nil || attempt >= p.MaxAttempts {
+		return false
+	}
+	return p.statuses[strconv.Itoa(int(code))] || (name != "" && p.statuses[name])
+}
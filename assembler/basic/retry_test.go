@@ -0,0 +1,38 @@
+package basic
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	p, err := RetryConfig{MaxAttempts: 3, Codes: []string{"Unavailable"}, Statuses: []string{"INTERNAL_SERVER_ERROR", "503"}}.Policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		got  bool
+		want bool
+	}{
+		// 背书应答只有数字，名字要能匹配到对应的数字
+		{"status name without name", p.RetryStatus(1, 500, ""), true},
+		{"status number", p.RetryStatus(1, 503, "SERVICE_UNAVAILABLE"), true},
+		{"status not listed", p.RetryStatus(1, 400, "BAD_REQUEST"), false},
+		{"last attempt", p.RetryStatus(3, 500, ""), false},
+		{"grpc code", p.RetryError(1, status.Error(codes.Unavailable, "down")), true},
+		{"grpc code not listed", p.RetryError(1, status.Error(codes.Internal, "bug")), false},
+	}
+	for _, c := range cases {
+		if c.got != c.want {
+			t.Errorf("%s: expect %t, got %t", c.name, c.want, c.got)
+		}
+	}
+
+	var none *RetryPolicy
+	if none.RetryStatus(1, 500, "") || none.RetryError(1, status.Error(codes.Unavailable, "")) {
+		t.Error("nil policy must not retry")
+	}
+}
@@ -0,0 +1,248 @@
+package basic
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	cpuSaturation     = 0.9                    // 进程CPU占所有核的比例超过它认为饱和
+	channelSaturation = 0.9                    // 本地消费的channel填充超过它认为饱和
+	gcPauseWarning    = 100 * time.Millisecond // 单次GC暂停超过它时告警
+	warnInterval      = 5 * time.Second        // 告警最多每5秒打印一次
+)
+
+var (
+	runtimeCPU        = NewGaugeVec("stupid_client_cpu_ratio", "CPU used by the generator as a fraction of all cores.")
+	runtimeGoroutines = NewGaugeVec("stupid_client_goroutines", "Number of goroutines in the generator.")
+	runtimeHeap       = NewGaugeVec("stupid_client_heap_bytes", "Heap bytes allocated by the generator.")
+	runtimeGCPause    = NewHistogramVec("stupid_client_gc_pause_seconds", "GC stop-the-world pauses of the generator.", LatencyBuckets)
+	channelFill       = NewGaugeVec("stupid_client_channel_fill_ratio", "Fill level of an internal channel, len/cap.", "channel")
+)
+
+// ChannelFill 内部channel的长度和容量，Local表示由本进程的goroutine消费，
+// 它满了说明客户端自己处理不过来，否则是下游(peer、orderer)的反压
+type ChannelFill struct {
+	Name  string `json:"name"`
+	Len   int    `json:"len"`
+	Cap   int    `json:"cap"`
+	Local bool   `json:"local"`
+}
+
+func (c ChannelFill) Ratio() float64 {
+	if c.Cap == 0 {
+		return 0
+	}
+	return float64(c.Len) / float64(c.Cap)
+}
+
+// RuntimeSample 生成器自身的资源使用
+type RuntimeSample struct {
+	CPU        float64       `json:"cpu"`
+	Goroutines int           `json:"goroutines"`
+	HeapBytes  uint64        `json:"heap_bytes"`
+	NumGC      uint32        `json:"num_gc"`
+	GCPauseMax float64       `json:"gc_pause_max_seconds"` // 上次采样以来最长的GC暂停
+	Channels   []ChannelFill `json:"channels"`
+	Saturated  []string      `json:"saturated,omitempty"` // 客户端饱和的原因
+}
+
+// ClientReport 整个运行期间生成器自身的资源使用峰值
+type ClientReport struct {
+	Samples          int                `json:"samples"`
+	SaturatedSamples int                `json:"saturated_samples"`
+	PeakCPU          float64            `json:"peak_cpu"`
+	PeakGoroutines   int                `json:"peak_goroutines"`
+	PeakHeapBytes    uint64             `json:"peak_heap_bytes"`
+	NumGC            uint32             `json:"num_gc"`
+	GCPauseMax       float64            `json:"gc_pause_max_seconds"`
+	GCPauseTotal     float64            `json:"gc_pause_total_seconds"`
+	PeakChannels     map[string]float64 `json:"peak_channel_fill"`
+	Reasons          map[string]int     `json:"saturation_reasons"` // 每种原因出现的采样次数
+}
+
+// Saturated 运行期间超过5%的采样处于饱和，结果可能受限于客户端
+func (r *ClientReport) Saturated() bool {
+	return r.Samples > 0 && r.SaturatedSamples*20 > r.Samples
+}
+
+// SelfMonitor 周期性地采样生成器的CPU、goroutine、GC、堆以及内部channel
+type SelfMonitor struct {
+	channels func() []ChannelFill
+
+	lock     sync.Mutex
+	current  *RuntimeSample
+	report   ClientReport
+	lastTime time.Time
+	lastCPU  time.Duration
+	lastGC   uint32
+	lastWarn time.Time
+}
+
+// StartSelfMonitor ctx取消后停止采样，已有的采样和峰值仍然可以读取
+func StartSelfMonitor(ctx context.Context, interval time.Duration, channels func() []ChannelFill) *SelfMonitor {
+	m := &SelfMonitor{
+		channels: channels,
+		current:  &RuntimeSample{},
+		report: ClientReport{
+			PeakChannels: make(map[string]float64),
+			Reasons:      make(map[string]int),
+		},
+		lastTime: time.Now(),
+		lastCPU:  processCPUTime(),
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	m.lastGC = ms.NumGC
+
+	runtimeCPU.Set(func() float64 { return m.Get().CPU })
+	runtimeGoroutines.Set(func() float64 { return float64(runtime.NumGoroutine()) })
+	runtimeHeap.Set(func() float64 { return float64(m.Get().HeapBytes) })
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				m.sample()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return m
+}
+
+// processCPUTime 进程累计使用的用户态和内核态CPU时间
+func processCPUTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func (m *SelfMonitor) sample() {
+	now := time.Now()
+	cpu := processCPUTime()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	s := &RuntimeSample{
+		Goroutines: runtime.NumGoroutine(),
+		HeapBytes:  ms.HeapAlloc,
+		NumGC:      ms.NumGC,
+		Channels:   m.channels(),
+	}
+	if wall := now.Sub(m.lastTime); wall > 0 {
+		s.CPU = float64(cpu-m.lastCPU) / float64(wall) / float64(runtime.NumCPU())
+	}
+
+	// PauseNs是最近256次GC的环形缓冲区
+	var pauseTotal time.Duration
+	for n := m.lastGC + 1; n <= ms.NumGC && ms.NumGC-n < uint32(len(ms.PauseNs)); n++ {
+		pause := time.Duration(ms.PauseNs[(n+uint32(len(ms.PauseNs))-1)%uint32(len(ms.PauseNs))])
+		runtimeGCPause.With().Observe(pause.Seconds())
+		pauseTotal += pause
+		if pause.Seconds() > s.GCPauseMax {
+			s.GCPauseMax = pause.Seconds()
+		}
+	}
+
+	if s.CPU >= cpuSaturation {
+		s.Saturated = append(s.Saturated, fmt.Sprintf("cpu %.0f%%", s.CPU*100))
+	}
+	if s.GCPauseMax >= gcPauseWarning.Seconds() {
+		s.Saturated = append(s.Saturated, fmt.Sprintf("gc pause %.0fms", s.GCPauseMax*1e3))
+	}
+	for _, c := range s.Channels {
+		channelFill.Set(c.Ratio, c.Name)
+		if c.Local && c.Ratio() >= channelSaturation {
+			s.Saturated = append(s.Saturated, fmt.Sprintf("%s %.0f%% full", c.Name, c.Ratio()*100))
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.current = s
+	m.lastTime, m.lastCPU, m.lastGC = now, cpu, ms.NumGC
+
+	r := &m.report
+	r.Samples++
+	r.NumGC = ms.NumGC
+	r.GCPauseTotal += pauseTotal.Seconds()
+	if s.CPU > r.PeakCPU {
+		r.PeakCPU = s.CPU
+	}
+	if s.Goroutines > r.PeakGoroutines {
+		r.PeakGoroutines = s.Goroutines
+	}
+	if s.HeapBytes > r.PeakHeapBytes {
+		r.PeakHeapBytes = s.HeapBytes
+	}
+	if s.GCPauseMax > r.GCPauseMax {
+		r.GCPauseMax = s.GCPauseMax
+	}
+	for _, c := range s.Channels {
+		if c.Ratio() > r.PeakChannels[c.Name] {
+			r.PeakChannels[c.Name] = c.Ratio()
+		}
+	}
+	if len(s.Saturated) == 0 {
+		return
+	}
+	r.SaturatedSamples++
+	for _, reason := range s.Saturated {
+		r.Reasons[strings.SplitN(reason, " ", 2)[0]]++
+	}
+	if now.Sub(m.lastWarn) >= warnInterval {
+		m.lastWarn = now
+		Logf("WARNING: generator is saturated (%s), results may be limited by the client rather than Fabric",
+			strings.Join(s.Saturated, ", "))
+	}
+}
+
+// Get 返回最近一次采样
+func (m *SelfMonitor) Get() *RuntimeSample {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.current
+}
+
+func (m *SelfMonitor) Report() ClientReport {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	r := m.report
+	r.PeakChannels = make(map[string]float64, len(m.report.PeakChannels))
+	for k, v := range m.report.PeakChannels {
+		r.PeakChannels[k] = v
+	}
+	r.Reasons = make(map[string]int, len(m.report.Reasons))
+	for k, v := range m.report.Reasons {
+		r.Reasons[k] = v
+	}
+	return r
+}
+
+// GetRuntimeInfo 文本输出用
+func GetRuntimeInfo(s *RuntimeSample) string {
+	info := fmt.Sprintf("Client: cpu(%5.1f%%),goroutines(%6d),heap(%8.1fMB),gc(%6d),gc pause max(%.1fms)\n",
+		s.CPU*100, s.Goroutines, float64(s.HeapBytes)/(1<<20), s.NumGC, s.GCPauseMax*1e3)
+	var fills []string
+	for _, c := range s.Channels {
+		fills = append(fills, fmt.Sprintf("%s(%d/%d)", c.Name, c.Len, c.Cap))
+	}
+	if len(fills) > 0 {
+		info += "Channels: " + strings.Join(fills, ",") + "\n"
+	}
+	if len(s.Saturated) > 0 {
+		info += "SATURATED: " + strings.Join(s.Saturated, ", ") + "\n"
+	}
+	return info
+}
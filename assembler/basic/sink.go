@@ -0,0 +1,343 @@
+package basic
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SinkInfluxHTTP = "influx-http"
+	SinkInfluxUDP  = "influx-udp"
+	SinkStatsD     = "statsd"
+
+	defaultSinkInterval = 10 * time.Second
+	maxDatagramSize     = 1400 // 避免UDP分片
+)
+
+// SinkConfig 推送指标的目标，Addr对influx-http是URL(http://host:8086)，其它是host:port
+type SinkConfig struct {
+	Type     string `json:"type"`
+	Addr     string `json:"addr"`
+	Database string `json:"database"`
+	Prefix   string `json:"prefix"`
+	Interval string `json:"interval"`
+}
+
+// Sink 周期性地把统计推送到外部收集器
+type Sink interface {
+	Push(s *Sample, latency []LatencyReport) error
+	Close() error
+}
+
+// SampleSource 返回当前的累计统计和时延
+type SampleSource func() (*Sample, []LatencyReport)
+
+func NewSink(c SinkConfig) (Sink, error) {
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = "stupid"
+	}
+
+	switch c.Type {
+	case SinkInfluxHTTP:
+		u, err := url.Parse(c.Addr)
+		if err != nil {
+			return nil, err
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+		q := u.Query()
+		q.Set("db", c.Database)
+		q.Set("precision", "ns")
+		u.RawQuery = q.Encode()
+		return &influxHTTPSink{url: u.String(), prefix: measurementEscaper.Replace(prefix), client: &http.Client{Timeout: 5 * time.Second}}, nil
+	case SinkInfluxUDP, SinkStatsD:
+		conn, err := net.Dial("udp", c.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if c.Type == SinkInfluxUDP {
+			return &influxUDPSink{conn: conn, prefix: measurementEscaper.Replace(prefix)}, nil
+		}
+		return &statsdSink{conn: conn, prefix: statsdEscaper.Replace(prefix)}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %s", c.Type)
+	}
+}
+
+// GetInterval 推送间隔，未配置时为10s
+func (c SinkConfig) GetInterval() (time.Duration, error) {
+	if c.Interval == "" {
+		return defaultSinkInterval, nil
+	}
+	d, err := time.ParseDuration(c.Interval)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("sink interval must be positive, got %s", c.Interval)
+	}
+	return d, nil
+}
+
+// sinkRunners 正在运行的推送，StopSinks通过stop通知它们最后推送一次
+var sinkRunners struct {
+	lock sync.Mutex
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// StartSinks 为每个配置启动一个推送goroutine，配置有误时返回错误且不启动任何推送
+func StartSinks(configs []SinkConfig, source SampleSource) error {
+	var sinks []Sink
+	var intervals []time.Duration
+	for _, c := range configs {
+		sink, interval, err := openSink(c)
+		if err != nil {
+			for _, s := range sinks {
+				s.Close()
+			}
+			return fmt.Errorf("sink %s %s: %s", c.Type, c.Addr, err)
+		}
+		sinks = append(sinks, sink)
+		intervals = append(intervals, interval)
+	}
+
+	sinkRunners.lock.Lock()
+	defer sinkRunners.lock.Unlock()
+	if sinkRunners.stop == nil {
+		sinkRunners.stop = make(chan struct{})
+	}
+	for i := range sinks {
+		sinkRunners.wg.Add(1)
+		go runSink(sinks[i], intervals[i], source, sinkRunners.stop)
+	}
+	return nil
+}
+
+// StopSinks 推送最后一个间隔的统计并关闭所有sink，在输出最终报告之前调用
+func StopSinks() {
+	sinkRunners.lock.Lock()
+	if sinkRunners.stop != nil {
+		close(sinkRunners.stop)
+		sinkRunners.stop = nil
+	}
+	sinkRunners.lock.Unlock()
+	sinkRunners.wg.Wait()
+}
+
+func openSink(c SinkConfig) (Sink, time.Duration, error) {
+	interval, err := c.GetInterval()
+	if err != nil {
+		return nil, 0, err
+	}
+	sink, err := NewSink(c)
+	return sink, interval, err
+}
+
+func runSink(sink Sink, interval time.Duration, source SampleSource, stop <-chan struct{}) {
+	defer sinkRunners.wg.Done()
+	defer sink.Close()
+	last, _ := source()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		stopped := false
+		select {
+		case <-t.C:
+		case <-stop:
+			stopped = true
+		}
+		s, latency := source()
+		s.Fill(last)
+		last = s
+		if err := sink.Push(s, latency); err != nil {
+			Logf("Failed to push metrics: %s", err)
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+var (
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", "_")
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", "_")
+	// statsd用:分隔名字和值，|分隔类型，@表示采样率，名字中不能出现
+	statsdEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", " ", "_", "\n", "_")
+)
+
+// statsdSegment 名字中的一段，.也替换掉，避免节点地址之类的值被拆成多级
+func statsdSegment(s string) string {
+	return statsdEscaper.Replace(strings.Replace(s, ".", "_", -1))
+}
+
+// influxLines 把采样转换成InfluxDB line protocol
+func influxLines(prefix string, s *Sample, latency []LatencyReport) []string {
+	ts := s.Time.UnixNano()
+	var lines []string
+	for _, st := range s.Stages {
+		lines = append(lines, fmt.Sprintf("%s_stage,stage=%s total=%di,success=%di,fail=%di,retried=%di,total_delta=%di,success_delta=%di,fail_delta=%di,retried_delta=%di %d",
+			prefix, tagEscaper.Replace(st.Stage), st.Total, st.Success, st.Fail, st.Retried, st.TotalDelta, st.SuccessDelta, st.FailDelta, st.RetriedDelta, ts))
+	}
+	for _, e := range s.Endpoints {
+		lines = append(lines, fmt.Sprintf("%s_endpoint,stage=%s,endpoint=%s,conn=%d total=%di,success=%di,fail=%di,latency_mean=%g,latency_p99=%g %d",
+			prefix, tagEscaper.Replace(e.Stage), tagEscaper.Replace(e.Endpoint), e.Conn, e.Total, e.Success, e.Fail, e.LatencyMean, e.LatencyP99, ts))
+	}
+	lines = append(lines, fmt.Sprintf("%s_commit committed=%di,committed_delta=%di,tps=%g %d",
+		prefix, s.Committed, s.CommitDelta, s.CommitTPS, ts))
+	for _, q := range sortedQueues(s.Queues) {
+		lines = append(lines, fmt.Sprintf("%s_queue,queue=%s depth=%di %d", prefix, tagEscaper.Replace(q), s.Queues[q], ts))
+	}
+	lines = append(lines, fmt.Sprintf("%s_rate target=%di,schedule_lag=%g %d", prefix, s.TargetRate, s.ScheduleLag, ts))
+	if rt := s.Runtime; rt != nil {
+		lines = append(lines, fmt.Sprintf("%s_client cpu=%g,goroutines=%di,heap_bytes=%di,gc_pause_max=%g,saturated=%t %d",
+			prefix, rt.CPU, rt.Goroutines, rt.HeapBytes, rt.GCPauseMax, len(rt.Saturated) > 0, ts))
+	}
+	if s.Server != nil {
+		for _, m := range s.Server.Metrics {
+			lines = append(lines, fmt.Sprintf("%s_server,node=%s,metric=%s value=%g,delta=%g,mean=%g,p99=%g %d",
+				prefix, tagEscaper.Replace(m.Node), tagEscaper.Replace(m.Metric), m.Value, m.Delta, m.Mean, m.P99, s.Server.Time.UnixNano()))
+		}
+	}
+	for _, l := range latency {
+		lines = append(lines, fmt.Sprintf("%s_latency,stage=%s count=%di,mean=%g,p50=%g,p90=%g,p95=%g,p99=%g,p999=%g,max=%g %d",
+			prefix, tagEscaper.Replace(l.Stage), l.Count, l.Mean, l.P50, l.P90, l.P95, l.P99, l.P999, l.Max, ts))
+	}
+	return lines
+}
+
+// statsdLines 累计值作为gauge，增量作为counter，时延单位毫秒
+func statsdLines(prefix string, s *Sample, latency []LatencyReport) []string {
+	var lines []string
+	for _, st := range s.Stages {
+		p := prefix + "." + statsdSegment(st.Stage)
+		lines = append(lines,
+			fmt.Sprintf("%s.total:%d|c", p, st.TotalDelta),
+			fmt.Sprintf("%s.success:%d|c", p, st.SuccessDelta),
+			fmt.Sprintf("%s.fail:%d|c", p, st.FailDelta),
+		)
+	}
+	lines = append(lines,
+		fmt.Sprintf("%s.commit.committed:%d|c", prefix, s.CommitDelta),
+		fmt.Sprintf("%s.commit.tps:%g|g", prefix, s.CommitTPS),
+		fmt.Sprintf("%s.rate.target:%d|g", prefix, s.TargetRate),
+		fmt.Sprintf("%s.rate.schedule_lag:%g|g", prefix, s.ScheduleLag*1e3),
+	)
+	for _, q := range sortedQueues(s.Queues) {
+		lines = append(lines, fmt.Sprintf("%s.queue.%s:%d|g", prefix, statsdSegment(q), s.Queues[q]))
+	}
+	if rt := s.Runtime; rt != nil {
+		lines = append(lines,
+			fmt.Sprintf("%s.client.cpu:%g|g", prefix, rt.CPU),
+			fmt.Sprintf("%s.client.goroutines:%d|g", prefix, rt.Goroutines),
+			fmt.Sprintf("%s.client.heap_bytes:%d|g", prefix, rt.HeapBytes),
+			fmt.Sprintf("%s.client.gc_pause_max:%g|g", prefix, rt.GCPauseMax*1e3),
+		)
+	}
+	if s.Server != nil {
+		for _, m := range s.Server.Metrics {
+			p := prefix + ".server." + statsdSegment(m.Node) + "." + statsdSegment(m.Metric)
+			lines = append(lines, fmt.Sprintf("%s.value:%g|g", p, m.Value), fmt.Sprintf("%s.mean:%g|g", p, m.Mean*1e3))
+		}
+	}
+	for _, l := range latency {
+		p := prefix + ".latency." + statsdSegment(l.Stage)
+		lines = append(lines,
+			fmt.Sprintf("%s.mean:%g|g", p, l.Mean*1e3),
+			fmt.Sprintf("%s.p50:%g|g", p, l.P50*1e3),
+			fmt.Sprintf("%s.p90:%g|g", p, l.P90*1e3),
+			fmt.Sprintf("%s.p99:%g|g", p, l.P99*1e3),
+			fmt.Sprintf("%s.max:%g|g", p, l.Max*1e3),
+		)
+	}
+	return lines
+}
+
+func sortedQueues(queues map[string]int) []string {
+	names := make([]string, 0, len(queues))
+	for q := range queues {
+		names = append(names, q)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeDatagrams 把多行文本按数据报大小分批发送
+func writeDatagrams(conn net.Conn, lines []string) error {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+len(line)+1 > maxDatagramSize {
+			if _, err := conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		_, err := conn.Write(buf.Bytes())
+		return err
+	}
+	return nil
+}
+
+type influxHTTPSink struct {
+	url    string
+	prefix string
+	client *http.Client
+}
+
+func (s *influxHTTPSink) Push(sample *Sample, latency []LatencyReport) error {
+	body := strings.Join(influxLines(s.prefix, sample, latency), "\n")
+	resp, err := s.client.Post(s.url, "text/plain", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("influx write returned %s: %s", resp.Status, msg)
+	}
+	return nil
+}
+
+func (s *influxHTTPSink) Close() error {
+	return nil
+}
+
+type influxUDPSink struct {
+	conn   net.Conn
+	prefix string
+}
+
+func (s *influxUDPSink) Push(sample *Sample, latency []LatencyReport) error {
+	return writeDatagrams(s.conn, influxLines(s.prefix, sample, latency))
+}
+
+func (s *influxUDPSink) Close() error {
+	return s.conn.Close()
+}
+
+type statsdSink struct {
+	conn   net.Conn
+	prefix string
+}
+
+func (s *statsdSink) Push(sample *Sample, latency []LatencyReport) error {
+	return writeDatagrams(s.conn, statsdLines(s.prefix, sample, latency))
+}
+
+func (s *statsdSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,113 @@
+package basic
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSample() *Sample {
+	return &Sample{
+		Time:        time.Unix(100, 0),
+		Stages:      []StageSample{{Stage: "proposal", Total: 10, TotalDelta: 4}},
+		Committed:   8,
+		CommitDelta: 3,
+		Queues:      map[string]int{"raw|0": 5},
+		Server: &ServerSample{Time: time.Unix(100, 0), Metrics: []ServerMetric{
+			{Node: "peer0:7051", Metric: "ledger@height", Value: 7},
+		}},
+	}
+}
+
+// listen 返回一个本地UDP监听，read读出一个数据报中的所有行
+func listen(t *testing.T) (net.PacketConn, func() []string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, func() []string {
+		buf := make([]byte, 64*1024)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(string(buf[:n]), "\n")
+	}
+}
+
+func find(lines []string, prefix string) string {
+	for _, l := range lines {
+		if strings.HasPrefix(l, prefix) {
+			return l
+		}
+	}
+	return ""
+}
+
+func TestInfluxUDPSink(t *testing.T) {
+	conn, read := listen(t)
+	defer conn.Close()
+	sink, err := NewSink(SinkConfig{Type: SinkInfluxUDP, Addr: conn.LocalAddr().String(), Prefix: "load test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err = sink.Push(testSample(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := read()
+	if l := find(lines, `load\ test_stage,`); l != `load\ test_stage,stage=proposal total=10i,success=0i,fail=0i,retried=0i,total_delta=4i,success_delta=0i,fail_delta=0i,retried_delta=0i 100000000000` {
+		t.Errorf("unexpected stage line %q", l)
+	}
+	if l := find(lines, `load\ test_commit `); l != `load\ test_commit committed=8i,committed_delta=3i,tps=0 100000000000` {
+		t.Errorf("unexpected commit line %q", l)
+	}
+}
+
+func TestStatsDSink(t *testing.T) {
+	conn, read := listen(t)
+	defer conn.Close()
+	sink, err := NewSink(SinkConfig{Type: SinkStatsD, Addr: conn.LocalAddr().String(), Prefix: "bench:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err = sink.Push(testSample(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := read()
+	for _, want := range []string{
+		"bench_1.proposal.total:4|c",
+		"bench_1.commit.committed:3|c",
+		"bench_1.queue.raw_0:5|g",
+		"bench_1.server.peer0_7051.ledger_height.value:7|g",
+	} {
+		if find(lines, want) == "" {
+			t.Errorf("missing %q in %q", want, lines)
+		}
+	}
+	// 每行只能有一个:和一个|，否则收集器解析错
+	for _, l := range lines {
+		if strings.Count(l, ":") != 1 || strings.Count(l, "|") != 1 || strings.Contains(l, "@") {
+			t.Errorf("malformed statsd line %q", l)
+		}
+	}
+}
+
+// StopSinks 不等下一个间隔，立即推送最后的统计
+func TestStopSinksFlush(t *testing.T) {
+	conn, read := listen(t)
+	defer conn.Close()
+	source := func() (*Sample, []LatencyReport) { return testSample(), nil }
+	if err := StartSinks([]SinkConfig{{Type: SinkStatsD, Addr: conn.LocalAddr().String(), Interval: "1h"}}, source); err != nil {
+		t.Fatal(err)
+	}
+	StopSinks()
+	if lines := read(); find(lines, "stupid.commit.committed:") == "" {
+		t.Errorf("no final push, got %q", lines)
+	}
+}
@@ -2,12 +2,17 @@ package basic
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	total = iota
 	succ
 	fail
+	retry // 失败后重试，不计入fail
+	sigButt
 )
 
 const (
@@ -18,77 +23,135 @@ const (
 
 var itemDesc = []string{"proposal", "broadcast"}
 
-type sig struct {
-	Item int
-	Sig  int
+const (
+	shardNum  = 64
+	cacheLine = 64
+)
+
+// shard 一组独立的计数器，按cache line对齐，避免不同分片之间的伪共享。
+// 填充放在前面：计数器正好占满时填充长度为0，放在末尾的零长度字段会让编译器再补8字节
+type shard struct {
+	_      [(cacheLine - (ItemButt*sigButt*8)%cacheLine) % cacheLine]byte
+	counts [ItemButt][sigButt]uint64
 }
 
-var globalStat *statHandler
+var globalStat = &statHandler{}
 
-func init() {
-	globalStat = &statHandler{
-		signal: make(chan *sig, 1000),
-	}
+var defaultRecorder = NewRecorder()
+
+type statHandler struct {
+	shards [shardNum]shard
+	next   uint32
 
-	go globalStat.Start()
+	lock sync.Mutex // 保护last
+	last [ItemButt]StatItem
 }
 
-type statHandler struct {
-	signal  chan *sig
-	last    [ItemButt]statItem
-	current [ItemButt]statItem
+// Recorder 绑定到一个分片上计数，每个worker持有自己的Recorder即可避免争用
+type Recorder struct {
+	s *shard
 }
 
-func AddTotal(item int) {
-	if item >= ItemButt {
+func NewRecorder() *Recorder {
+	i := atomic.AddUint32(&globalStat.next, 1) % shardNum
+	return &Recorder{s: &globalStat.shards[i]}
+}
+
+func (r *Recorder) AddTotal(item int) {
+	r.add(item, total)
+}
+
+func (r *Recorder) AddSuccess(item int) {
+	r.add(item, succ)
+}
+
+func (r *Recorder) AddFail(item int) {
+	r.add(item, fail)
+}
+
+// AddRetry 一次失败的尝试会被重试，最终结果再计入成功或失败
+func (r *Recorder) AddRetry(item int) {
+	r.add(item, retry)
+}
+
+func (r *Recorder) add(item, sig int) {
+	if item < 0 || item >= ItemButt {
 		return
 	}
-	globalStat.signal <- &sig{item, total}
+	atomic.AddUint64(&r.s.counts[item][sig], 1)
+}
+
+func AddTotal(item int) {
+	defaultRecorder.AddTotal(item)
 }
 
 func AddSuccess(item int) {
-	if item >= ItemButt {
-		return
-	}
-	globalStat.signal <- &sig{item, succ}
+	defaultRecorder.AddSuccess(item)
 }
 
 func AddFail(item int) {
-	if item >= ItemButt {
-		return
-	}
-	globalStat.signal <- &sig{item, fail}
+	defaultRecorder.AddFail(item)
+}
+
+// StatSnapshot 某一时刻所有分片汇总后的统计
+type StatSnapshot struct {
+	Time  time.Time
+	Items [ItemButt]StatItem
+}
+
+// Snapshot 汇总所有分片。总数总是先于成功/失败/重试计数，
+// 这里先读成功、失败和重试再读总数，保证快照中它们的和不会超过Total
+func Snapshot() StatSnapshot {
+	return globalStat.Snapshot()
 }
 
 func GetInfo() string {
 	return globalStat.GetInfo()
 }
 
-func (sh *statHandler) Start() {
-	for {
-		select {
-		case r := <-sh.signal:
-			if r.Sig == total {
-				sh.current[r.Item].Total += 1
-			} else if r.Sig == succ {
-				sh.current[r.Item].Success += 1
-			} else {
-				sh.current[r.Item].Fail += 1
-			}
+func GetStat(item int) StatItem {
+	return Snapshot().Items[item]
+}
+
+func GetItemDesc(item int) string {
+	return itemDesc[item]
+}
+
+func (sh *statHandler) Snapshot() StatSnapshot {
+	snap := StatSnapshot{Time: time.Now()}
+	for i := range sh.shards {
+		counts := &sh.shards[i].counts
+		for item := 0; item < ItemButt; item++ {
+			snap.Items[item].Success += atomic.LoadUint64(&counts[item][succ])
+			snap.Items[item].Fail += atomic.LoadUint64(&counts[item][fail])
+			snap.Items[item].Retried += atomic.LoadUint64(&counts[item][retry])
 		}
 	}
+	for i := range sh.shards {
+		counts := &sh.shards[i].counts
+		for item := 0; item < ItemButt; item++ {
+			snap.Items[item].Total += atomic.LoadUint64(&counts[item][total])
+		}
+	}
+	return snap
 }
 
 func (sh *statHandler) GetInfo() string {
+	snap := sh.Snapshot()
+
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+
 	info := "Statistic:\n" +
-		"                    Total(     Speed)   Success(     Speed)      Fail(     Speed)\n"
-	for i, curr := range sh.current{
+		"                    Total(     Speed)   Success(     Speed)      Fail(     Speed)   Retried(     Speed)\n"
+	for i, curr := range snap.Items {
 		last := &sh.last[i]
-		info += fmt.Sprintf("%-15s%10d(%10d)%10d(%10d)%10d(%10d)\n",
+		info += fmt.Sprintf("%-15s%10d(%10d)%10d(%10d)%10d(%10d)%10d(%10d)\n",
 			itemDesc[i],
 			curr.Total, curr.Total-last.Total,
 			curr.Success, curr.Success-last.Success,
 			curr.Fail, curr.Fail-last.Fail,
+			curr.Retried, curr.Retried-last.Retried,
 		)
 		last.Copy(curr)
 	}
@@ -96,14 +159,28 @@ func (sh *statHandler) GetInfo() string {
 	return info
 }
 
-type statItem struct {
+// GetEndpointInfo 以表格形式输出各节点或连接的累计统计
+func GetEndpointInfo(list []EndpointReport) string {
+	info := "Endpoints:\n" +
+		"                                                  Routed  Share(%)     Total   Success      Fail   Retried  Mean(ms)   P99(ms)    Reconn\n"
+	shares := RoutedShares(list)
+	for i, e := range list {
+		info += fmt.Sprintf("%-10s%-40s%10d%10.1f%10d%10d%10d%10d%10.1f%10.1f%10d\n",
+			e.Stage, e.Name(), e.Routed, shares[i]*100, e.Total, e.Success, e.Fail, e.Retried, e.Latency.Mean*1e3, e.Latency.P99*1e3, e.Reconnects)
+	}
+	return info
+}
+
+type StatItem struct {
 	Total   uint64
 	Success uint64
 	Fail    uint64
+	Retried uint64
 }
 
-func (s *statItem) Copy(src statItem) {
+func (s *StatItem) Copy(src StatItem) {
 	s.Total = src.Total
 	s.Success = src.Success
 	s.Fail = src.Fail
+	s.Retried = src.Retried
 }
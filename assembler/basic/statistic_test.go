@@ -0,0 +1,156 @@
+package basic
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func reportRate(b *testing.B, start time.Time) {
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "events/s")
+}
+
+// 每个goroutine持有自己的Recorder，这是infra中worker的用法
+func BenchmarkRecorderParallel(b *testing.B) {
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		r := NewRecorder()
+		for pb.Next() {
+			r.AddTotal(ItemProposal)
+		}
+	})
+	reportRate(b, start)
+}
+
+// 所有goroutine共用包级别的函数
+func BenchmarkAddTotalParallel(b *testing.B) {
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			AddTotal(ItemBroadcast)
+		}
+	})
+	reportRate(b, start)
+}
+
+func BenchmarkSnapshot(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Snapshot()
+	}
+}
+
+// 分片正好占满整数个cache line，计数器恰好一行时不需要填充
+func TestShardSize(t *testing.T) {
+	size := unsafe.Sizeof(shard{})
+	if size%cacheLine != 0 || size >= ItemButt*sigButt*8+cacheLine {
+		t.Fatalf("shard takes %d bytes, expect counters rounded up to %d-byte cache lines", size, cacheLine)
+	}
+}
+
+// parseInfo 解析GetInfo的一行，返回Total、Success、Fail、Retried的累计值和增量
+func parseInfo(t *testing.T, info string, item int) (curr, delta [4]uint64) {
+	for _, line := range strings.Split(info, "\n") {
+		fields := strings.Fields(strings.NewReplacer("(", " ", ")", " ").Replace(line))
+		if len(fields) != 9 || fields[0] != itemDesc[item] {
+			continue
+		}
+		for i := 0; i < 4; i++ {
+			var err error
+			if curr[i], err = strconv.ParseUint(fields[1+2*i], 10, 64); err != nil {
+				t.Fatal(err)
+			}
+			if delta[i], err = strconv.ParseUint(fields[2+2*i], 10, 64); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return
+	}
+	t.Fatalf("no %s line in %q", itemDesc[item], info)
+	return
+}
+
+// 并发计数时快照中成功、失败、重试之和不超过总数，结束后累计值和每次GetInfo的增量之和都准确
+func TestStatConcurrent(t *testing.T) {
+	const (
+		workers = 16
+		rounds  = 2000
+	)
+	sh := &statHandler{}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		// 两个worker共用一个分片，同一分片上也有争用
+		go func(r *Recorder) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				for item := 0; item < ItemButt; item++ {
+					r.AddTotal(item)
+					switch i % 4 {
+					case 0:
+						r.AddFail(item)
+					case 1:
+						r.AddRetry(item)
+						r.AddSuccess(item)
+					default:
+						r.AddSuccess(item)
+					}
+				}
+			}
+		}(&Recorder{s: &sh.shards[w/2]})
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	var sums [ItemButt][4]uint64
+	addDeltas := func(info string) {
+		for item := 0; item < ItemButt; item++ {
+			_, delta := parseInfo(t, info, item)
+			for i := range delta {
+				sums[item][i] += delta[i]
+			}
+		}
+	}
+	for running := true; running; {
+		select {
+		case <-finished:
+			running = false
+		default:
+		}
+		snap := sh.Snapshot()
+		for _, s := range snap.Items {
+			if s.Success+s.Fail > s.Total || s.Retried > s.Total {
+				t.Fatalf("snapshot counts exceed total: %+v", s)
+			}
+		}
+		addDeltas(sh.GetInfo())
+	}
+
+	expect := StatItem{
+		Total:   workers * rounds,
+		Success: workers * rounds * 3 / 4,
+		Fail:    workers * rounds / 4,
+		Retried: workers * rounds / 4,
+	}
+	snap := sh.Snapshot()
+	for item, s := range snap.Items {
+		if s != expect {
+			t.Errorf("%s: expect %+v, got %+v", itemDesc[item], expect, s)
+		}
+		if got := (StatItem{sums[item][0], sums[item][1], sums[item][2], sums[item][3]}); got != expect {
+			t.Errorf("%s: sum of deltas %+v, expect %+v", itemDesc[item], got, expect)
+		}
+	}
+	info := sh.GetInfo()
+	for item := 0; item < ItemButt; item++ {
+		curr, delta := parseInfo(t, info, item)
+		if curr != [4]uint64{expect.Total, expect.Success, expect.Fail, expect.Retried} || delta != [4]uint64{} {
+			t.Errorf("%s: unexpected info %v %v", itemDesc[item], curr, delta)
+		}
+	}
+}
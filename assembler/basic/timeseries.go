@@ -0,0 +1,218 @@
+package basic
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	FormatText = "text"
+)
+
+// Sample 某一时刻的累计统计，Delta和TPS由TimeSeries根据上一次采样计算
+type Sample struct {
+	Time        time.Time      `json:"time"`
+	Interval    float64        `json:"interval_seconds"`
+	Stages      []StageSample  `json:"stages"`
+	Committed   uint64         `json:"committed"`
+	CommitDelta uint64         `json:"committed_delta"`
+	CommitTPS   float64        `json:"commit_tps"`
+	Queues      map[string]int `json:"queues"`
+	TargetRate  uint           `json:"target_rate"`
+	ScheduleLag float64        `json:"schedule_lag_seconds"`
+
+	Endpoints []EndpointSample `json:"endpoints"`
+	Errors    []ErrorClass     `json:"errors,omitempty"` // 只在JSON中输出
+	Runtime   *RuntimeSample   `json:"runtime,omitempty"`
+	Server    *ServerSample    `json:"server,omitempty"`
+}
+
+// ServerSample 最近一次从Fabric运维端口抓取的指标，Time是抓取时间，和Sample.Time不一定相同
+type ServerSample struct {
+	Time    time.Time      `json:"time"`
+	Metrics []ServerMetric `json:"metrics"`
+}
+
+type StageSample struct {
+	Stage        string `json:"stage"`
+	Total        uint64 `json:"total"`
+	Success      uint64 `json:"success"`
+	Fail         uint64 `json:"fail"`
+	Retried      uint64 `json:"retried"`
+	TotalDelta   uint64 `json:"total_delta"`
+	SuccessDelta uint64 `json:"success_delta"`
+	FailDelta    uint64 `json:"fail_delta"`
+	RetriedDelta uint64 `json:"retried_delta"`
+}
+
+// EndpointSample 每个gRPC连接的累计统计，Stage字段沿用StageSample
+type EndpointSample struct {
+	StageSample
+	Endpoint    string  `json:"endpoint"`
+	Conn        int     `json:"conn"`
+	LatencyMean float64 `json:"latency_mean"`
+	LatencyP99  float64 `json:"latency_p99"`
+	Reconnects  uint64  `json:"reconnects"`
+	Routed      uint64  `json:"routed"`
+}
+
+func NewEndpointSample(e EndpointReport) EndpointSample {
+	return EndpointSample{
+		StageSample: StageSample{Stage: e.Stage, Total: e.Total, Success: e.Success, Fail: e.Fail, Retried: e.Retried},
+		Endpoint:    e.Endpoint,
+		Conn:        e.Conn,
+		LatencyMean: e.Latency.Mean,
+		LatencyP99:  e.Latency.P99,
+		Reconnects:  e.Reconnects,
+		Routed:      e.Routed,
+	}
+}
+
+func (s *StageSample) delta(last *StageSample) {
+	s.TotalDelta = s.Total - last.Total
+	s.SuccessDelta = s.Success - last.Success
+	s.FailDelta = s.Fail - last.Fail
+	s.RetriedDelta = s.Retried - last.Retried
+}
+
+// TimeSeries 把周期性的采样逐行写成CSV或JSON
+type TimeSeries struct {
+	format string
+	w      io.Writer
+	csv    *csv.Writer
+	last   *Sample
+	queues []string
+}
+
+func NewTimeSeries(w io.Writer, format string) (*TimeSeries, error) {
+	ts := &TimeSeries{format: format, w: w}
+	switch format {
+	case FormatJSON:
+	case FormatCSV:
+		ts.csv = csv.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown time series format %s", format)
+	}
+	return ts, nil
+}
+
+func (ts *TimeSeries) Write(s *Sample) error {
+	s.Fill(ts.last)
+	ts.last = s
+
+	if ts.format == FormatJSON {
+		line, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		_, err = ts.w.Write(append(line, '\n'))
+		return err
+	}
+
+	if ts.queues == nil {
+		for q := range s.Queues {
+			ts.queues = append(ts.queues, q)
+		}
+		sort.Strings(ts.queues)
+		if err := ts.csv.Write(ts.header(s)); err != nil {
+			return err
+		}
+	}
+	row := []string{s.Time.Format(time.RFC3339Nano), fmt.Sprintf("%.3f", s.Interval)}
+	for _, st := range s.Stages {
+		row = append(row,
+			fmt.Sprint(st.Total), fmt.Sprint(st.TotalDelta),
+			fmt.Sprint(st.Success), fmt.Sprint(st.SuccessDelta),
+			fmt.Sprint(st.Fail), fmt.Sprint(st.FailDelta),
+			fmt.Sprint(st.Retried), fmt.Sprint(st.RetriedDelta),
+		)
+	}
+	row = append(row, fmt.Sprint(s.Committed), fmt.Sprint(s.CommitDelta), fmt.Sprintf("%.2f", s.CommitTPS))
+	for _, q := range ts.queues {
+		row = append(row, fmt.Sprint(s.Queues[q]))
+	}
+	row = append(row, fmt.Sprint(s.TargetRate), fmt.Sprintf("%.3f", s.ScheduleLag))
+	rt := s.Runtime
+	if rt == nil {
+		rt = &RuntimeSample{}
+	}
+	row = append(row, fmt.Sprintf("%.3f", rt.CPU), fmt.Sprint(rt.Goroutines), fmt.Sprint(rt.HeapBytes),
+		fmt.Sprintf("%.6f", rt.GCPauseMax), fmt.Sprint(len(rt.Saturated) > 0))
+	for _, e := range s.Endpoints {
+		row = append(row,
+			fmt.Sprint(e.Total), fmt.Sprint(e.TotalDelta),
+			fmt.Sprint(e.Success), fmt.Sprint(e.SuccessDelta),
+			fmt.Sprint(e.Fail), fmt.Sprint(e.FailDelta),
+			fmt.Sprintf("%.6f", e.LatencyMean), fmt.Sprintf("%.6f", e.LatencyP99),
+			fmt.Sprint(e.Reconnects), fmt.Sprint(e.Routed),
+		)
+	}
+	if s.Server != nil {
+		for _, m := range s.Server.Metrics {
+			row = append(row, fmt.Sprintf("%g", m.Value), fmt.Sprintf("%g", m.Delta), fmt.Sprintf("%.6f", m.Mean), fmt.Sprintf("%.6f", m.P99))
+		}
+	}
+	if err := ts.csv.Write(row); err != nil {
+		return err
+	}
+	ts.csv.Flush()
+	return ts.csv.Error()
+}
+
+func (ts *TimeSeries) header(s *Sample) []string {
+	header := []string{"time", "interval_seconds"}
+	for _, st := range s.Stages {
+		for _, col := range []string{"total", "total_delta", "success", "success_delta", "fail", "fail_delta", "retried", "retried_delta"} {
+			header = append(header, st.Stage+"_"+col)
+		}
+	}
+	header = append(header, "committed", "committed_delta", "commit_tps")
+	for _, q := range ts.queues {
+		header = append(header, "queue_"+q)
+	}
+	header = append(header, "target_rate", "schedule_lag_seconds")
+	header = append(header, "client_cpu", "client_goroutines", "client_heap_bytes", "client_gc_pause_max_seconds", "client_saturated")
+	for _, e := range s.Endpoints {
+		prefix := fmt.Sprintf("%s@%s#%d_", e.Stage, e.Endpoint, e.Conn)
+		for _, col := range []string{"total", "total_delta", "success", "success_delta", "fail", "fail_delta", "latency_mean", "latency_p99", "reconnects", "routed"} {
+			header = append(header, prefix+col)
+		}
+	}
+	// 节点和指标来自配置，每次采样的顺序一致
+	if s.Server != nil {
+		for _, m := range s.Server.Metrics {
+			for _, col := range []string{"value", "delta", "mean", "p99"} {
+				header = append(header, m.Name()+"_"+col)
+			}
+		}
+	}
+	return header
+}
+
+// Fill 根据上一次采样计算间隔、增量和提交TPS
+func (s *Sample) Fill(last *Sample) {
+	if last == nil {
+		return
+	}
+
+	s.Interval = s.Time.Sub(last.Time).Seconds()
+	s.CommitDelta = s.Committed - last.Committed
+	if s.Interval > 0 {
+		s.CommitTPS = float64(s.CommitDelta) / s.Interval
+	}
+	for i := range s.Stages {
+		if i < len(last.Stages) {
+			s.Stages[i].delta(&last.Stages[i])
+		}
+	}
+	// 连接在启动时全部建立，前后两次采样的顺序一致
+	for i := range s.Endpoints {
+		if i < len(last.Endpoints) {
+			s.Endpoints[i].delta(&last.Endpoints[i].StageSample)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package basic
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 不依赖OpenTelemetry SDK，直接以OTLP/HTTP JSON格式导出span，参考：
+// https://opentelemetry.io/docs/specs/otlp/#otlphttp
+
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+
+	statusOK    = 1
+	statusError = 2
+
+	traceBatchSize     = 512
+	traceFlushInterval = time.Second
+	traceQueueSize     = 100000
+)
+
+// TraceConfig Endpoint形如http://jaeger:4318/v1/traces，SampleRatio取值[0,1]
+type TraceConfig struct {
+	Endpoint    string  `json:"endpoint"`
+	SampleRatio float64 `json:"sample_ratio"`
+	ServiceName string  `json:"service_name"`
+}
+
+var globalTracer *tracer
+
+type tracer struct {
+	endpoint  string
+	service   string
+	threshold uint64 // traceID低8字节小于它的交易被采样
+	client    *http.Client
+	spans     chan *otlpSpan
+	dropped   uint64 // atomic
+	wg        sync.WaitGroup
+
+	// StopTracing之后还在退出的goroutine可能继续记录span，关闭spans前先置closed
+	lock   sync.RWMutex
+	closed bool
+}
+
+// StartTracing 启动span导出，c为nil时不做任何事
+func StartTracing(c *TraceConfig) error {
+	if c == nil || c.Endpoint == "" {
+		return nil
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("trace sample_ratio must be within [0, 1], got %g", c.SampleRatio)
+	}
+	service := c.ServiceName
+	if service == "" {
+		service = "stupid"
+	}
+
+	t := &tracer{
+		endpoint: c.Endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		spans:    make(chan *otlpSpan, traceQueueSize),
+	}
+	if c.SampleRatio >= 1 {
+		t.threshold = math.MaxUint64
+	} else {
+		t.threshold = uint64(c.SampleRatio * math.MaxUint64)
+	}
+	t.wg.Add(1)
+	go t.export()
+	globalTracer = t
+	return nil
+}
+
+// StopTracing 导出剩余的span，之后记录的span被丢弃
+func StopTracing() {
+	t := globalTracer
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return
+	}
+	t.closed = true
+	close(t.spans)
+	t.lock.Unlock()
+	t.wg.Wait()
+	if n := atomic.LoadUint64(&t.dropped); n > 0 {
+		Logf("%d spans dropped because export queue was full or tracing had stopped", n)
+	}
+}
+
+// Trace 一个交易的生命周期，所有阶段的span都挂在同一个根span下。
+// 未开启追踪或未被采样时为nil，nil上的方法什么都不做
+type Trace struct {
+	txid    string
+	traceID [16]byte
+	rootID  [8]byte
+	start   time.Time
+}
+
+// NewTrace traceID由TxID导出，同一个交易在多次运行或者多个进程中得到相同的traceID
+func NewTrace(txid string, start time.Time) *Trace {
+	t := globalTracer
+	if t == nil {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(txid))
+	if t.threshold != math.MaxUint64 && binary.BigEndian.Uint64(sum[8:16]) >= t.threshold {
+		return nil
+	}
+	tr := &Trace{txid: txid, start: start}
+	copy(tr.traceID[:], sum[:16])
+	tr.rootID = tr.spanID("transaction", "", 1)
+	return tr
+}
+
+// spanID attempt区分同一个阶段在同一个节点上的多次尝试
+func (tr *Trace) spanID(name, endpoint string, attempt int) [8]byte {
+	var id [8]byte
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s|%d", tr.txid, name, endpoint, attempt)))
+	copy(id[:], sum[:8])
+	return id
+}
+
+// TraceParent 返回W3C traceparent，传给peer以便和它自己的trace关联，参数和随后的Span相同
+func (tr *Trace) TraceParent(name, endpoint string, attempt int) string {
+	if tr == nil {
+		return ""
+	}
+	id := tr.spanID(name, endpoint, attempt)
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(tr.traceID[:]), hex.EncodeToString(id[:]))
+}
+
+// Span 记录一个阶段，endpoint为空时是本地处理，attempt为第几次尝试(从1开始)，err非空时标记为失败
+func (tr *Trace) Span(name, endpoint string, attempt int, start, end time.Time, status string, err error) {
+	if tr == nil {
+		return
+	}
+	id := tr.spanID(name, endpoint, attempt)
+	s := tr.newSpan(name, id, tr.rootID[:], start, end, status, err)
+	if endpoint != "" {
+		s.Kind = spanKindClient
+		s.Attributes = append(s.Attributes, stringAttr("net.peer.name", endpoint))
+	}
+	if attempt > 1 {
+		s.Attributes = append(s.Attributes, stringAttr("stupid.attempt", fmt.Sprintf("%d", attempt)))
+	}
+	globalTracer.enqueue(s)
+}
+
+// Finish 结束根span，交易上链或者中途失败时调用
+func (tr *Trace) Finish(status string, err error) {
+	if tr == nil {
+		return
+	}
+	globalTracer.enqueue(tr.newSpan("transaction", tr.rootID, nil, tr.start, time.Now(), status, err))
+}
+
+func (tr *Trace) newSpan(name string, id [8]byte, parent []byte, start, end time.Time, status string, err error) *otlpSpan {
+	s := &otlpSpan{
+		TraceID:   hex.EncodeToString(tr.traceID[:]),
+		SpanID:    hex.EncodeToString(id[:]),
+		Name:      name,
+		Kind:      spanKindInternal,
+		StartTime: fmt.Sprintf("%d", start.UnixNano()),
+		EndTime:   fmt.Sprintf("%d", end.UnixNano()),
+		Attributes: []otlpAttr{
+			stringAttr("fabric.txid", tr.txid),
+		},
+		Status: otlpStatus{Code: statusOK},
+	}
+	if parent != nil {
+		s.ParentSpanID = hex.EncodeToString(parent)
+	}
+	if status != "" {
+		s.Attributes = append(s.Attributes, stringAttr("fabric.status", status))
+	}
+	if err != nil {
+		s.Status = otlpStatus{Code: statusError, Message: err.Error()}
+	}
+	return s
+}
+
+func (t *tracer) enqueue(s *otlpSpan) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if t.closed {
+		atomic.AddUint64(&t.dropped, 1)
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+func (t *tracer) export() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*otlpSpan, 0, traceBatchSize)
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				t.flush(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		t.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+func (t *tracer) flush(batch []*otlpSpan) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttr{stringAttr("service.name", t.service)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "stupid"}, Spans: batch}},
+	}}})
+	if err != nil {
+		Logf("Failed to encode spans: %s", err)
+		return
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		Logf("Failed to export spans: %s", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		Logf("Failed to export spans: %s: %s", resp.Status, msg)
+	}
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope   `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	StartTime    string     `json:"startTimeUnixNano"`
+	EndTime      string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes"`
+	Status       otlpStatus `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string        `json:"key"`
+	Value otlpAttrValue `json:"value"`
+}
+
+type otlpAttrValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func stringAttr(k, v string) otlpAttr {
+	return otlpAttr{Key: k, Value: otlpAttrValue{StringValue: v}}
+}
@@ -0,0 +1,216 @@
+package basic
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// otlpCollector 模拟OTLP/HTTP接收端，每次导出的请求解码后送入返回的channel
+func otlpCollector(t *testing.T) (*httptest.Server, chan otlpRequest) {
+	requests := make(chan otlpRequest, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("bad body: %s", err)
+		}
+		requests <- req
+	}))
+	return srv, requests
+}
+
+func startTracing(t *testing.T, c *TraceConfig) {
+	if err := StartTracing(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stopTracing 结束后清掉全局tracer，避免影响其它测试
+func stopTracing() {
+	StopTracing()
+	globalTracer = nil
+}
+
+// received 取出所有已经送达的span
+func received(requests chan otlpRequest) []*otlpSpan {
+	var spans []*otlpSpan
+	for {
+		select {
+		case req := <-requests:
+			for _, rs := range req.ResourceSpans {
+				for _, ss := range rs.ScopeSpans {
+					spans = append(spans, ss.Spans...)
+				}
+			}
+		default:
+			return spans
+		}
+	}
+}
+
+func expectID(txid, name, endpoint string, attempt int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s|%d", txid, name, endpoint, attempt)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func attr(s *otlpSpan, key string) string {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value.StringValue
+		}
+	}
+	return ""
+}
+
+func TestTraceExport(t *testing.T) {
+	srv, requests := otlpCollector(t)
+	defer srv.Close()
+	startTracing(t, &TraceConfig{Endpoint: srv.URL, SampleRatio: 1})
+	defer stopTracing()
+
+	start := time.Now()
+	tr := NewTrace("tx1", start)
+	if tr == nil {
+		t.Fatal("sample_ratio 1 should sample every transaction")
+	}
+	tr.Span("endorsement", "peer0:7051", 1, start, start.Add(time.Millisecond), "", errors.New("timeout"))
+	tr.Span("endorsement", "peer0:7051", 2, start, start.Add(time.Millisecond), "", nil)
+	tr.Span("integration", "", 1, start, start.Add(time.Millisecond), "", nil)
+	tr.Finish("VALID", nil)
+	StopTracing()
+
+	sum := sha256.Sum256([]byte("tx1"))
+	traceID := hex.EncodeToString(sum[:16])
+	rootID := expectID("tx1", "transaction", "", 1)
+	spans := map[string]*otlpSpan{}
+	for _, s := range received(requests) {
+		if s.TraceID != traceID {
+			t.Errorf("span %s: trace id %s, expect %s", s.Name, s.TraceID, traceID)
+		}
+		spans[s.SpanID] = s
+	}
+	if len(spans) != 4 {
+		t.Fatalf("expect 4 distinct spans, got %d", len(spans))
+	}
+
+	root := spans[rootID]
+	if root == nil || root.Name != "transaction" || root.ParentSpanID != "" || attr(root, "fabric.status") != "VALID" {
+		t.Errorf("bad root span %+v", root)
+	}
+	first := spans[expectID("tx1", "endorsement", "peer0:7051", 1)]
+	retry := spans[expectID("tx1", "endorsement", "peer0:7051", 2)]
+	local := spans[expectID("tx1", "integration", "", 1)]
+	if first == nil || retry == nil || local == nil {
+		t.Fatalf("missing stage spans, got %v", spans)
+	}
+	for _, s := range []*otlpSpan{first, retry, local} {
+		if s.ParentSpanID != rootID {
+			t.Errorf("span %s: parent %s, expect root %s", s.Name, s.ParentSpanID, rootID)
+		}
+	}
+	if first.Status.Code != statusError || first.Status.Message != "timeout" || retry.Status.Code != statusOK {
+		t.Errorf("bad status: first %+v, retry %+v", first.Status, retry.Status)
+	}
+	if first.Kind != spanKindClient || attr(first, "net.peer.name") != "peer0:7051" || local.Kind != spanKindInternal {
+		t.Errorf("bad kind: first %d, local %d", first.Kind, local.Kind)
+	}
+	if attr(first, "stupid.attempt") != "" || attr(retry, "stupid.attempt") != "2" {
+		t.Errorf("bad attempt attribute: first %q, retry %q", attr(first, "stupid.attempt"), attr(retry, "stupid.attempt"))
+	}
+	if p := tr.TraceParent("endorsement", "peer0:7051", 2); p != "00-"+traceID+"-"+retry.SpanID+"-01" {
+		t.Errorf("traceparent %s does not point to the retry span", p)
+	}
+
+	// 停止之后记录的span不再导出，只计数
+	tr.Span("endorsement", "peer0:7051", 3, start, start, "", nil)
+	tr.Finish("VALID", nil)
+	if n := atomic.LoadUint64(&globalTracer.dropped); n != 2 {
+		t.Errorf("expect 2 spans dropped after StopTracing, got %d", n)
+	}
+	if spans := received(requests); len(spans) != 0 {
+		t.Errorf("spans exported after StopTracing: %v", spans)
+	}
+}
+
+func TestTraceSampling(t *testing.T) {
+	if err := StartTracing(&TraceConfig{Endpoint: "http://127.0.0.1:0", SampleRatio: 1.5}); err == nil {
+		t.Error("expect error for sample_ratio above 1")
+	}
+
+	startTracing(t, &TraceConfig{Endpoint: "http://127.0.0.1:0", SampleRatio: 0.25})
+	threshold := globalTracer.threshold
+	sampled := 0
+	for i := 0; i < 4000; i++ {
+		txid := fmt.Sprintf("tx%d", i)
+		tr := NewTrace(txid, time.Now())
+		sum := sha256.Sum256([]byte(txid))
+		if (tr != nil) != (binary.BigEndian.Uint64(sum[8:16]) < threshold) {
+			t.Fatalf("%s: sampled %v against threshold %d", txid, tr != nil, threshold)
+		}
+		if tr != nil {
+			sampled++
+		}
+		if (NewTrace(txid, time.Now()) != nil) != (tr != nil) {
+			t.Fatalf("%s: sampling is not deterministic", txid)
+		}
+	}
+	stopTracing()
+	if sampled < 800 || sampled > 1200 {
+		t.Errorf("expect about 1000 of 4000 sampled at ratio 0.25, got %d", sampled)
+	}
+
+	startTracing(t, &TraceConfig{Endpoint: "http://127.0.0.1:0", SampleRatio: 0})
+	defer stopTracing()
+	for i := 0; i < 1000; i++ {
+		if NewTrace(fmt.Sprintf("tx%d", i), time.Now()) != nil {
+			t.Fatal("sample_ratio 0 should sample nothing")
+		}
+	}
+}
+
+// 攒满一批立即导出，不等下一次定时刷新
+func TestTraceBatchFlush(t *testing.T) {
+	srv, requests := otlpCollector(t)
+	defer srv.Close()
+	startTracing(t, &TraceConfig{Endpoint: srv.URL, SampleRatio: 1, ServiceName: "bench"})
+	defer stopTracing()
+
+	start := time.Now()
+	tr := NewTrace("tx1", start)
+	for i := 1; i <= traceBatchSize+10; i++ {
+		tr.Span("endorsement", "peer0:7051", i, start, start, "", nil)
+	}
+	select {
+	case req := <-requests:
+		if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+			t.Fatalf("bad request %+v", req)
+		}
+		if n := len(req.ResourceSpans[0].ScopeSpans[0].Spans); n != traceBatchSize {
+			t.Errorf("expect a full batch of %d spans, got %d", traceBatchSize, n)
+		}
+		if a := req.ResourceSpans[0].Resource.Attributes; len(a) != 1 || a[0] != stringAttr("service.name", "bench") {
+			t.Errorf("bad resource attributes %v", a)
+		}
+	case <-time.After(traceFlushInterval / 2):
+		t.Fatal("full batch was not exported before the flush interval")
+	}
+
+	StopTracing()
+	if n := len(received(requests)); n != 10 {
+		t.Errorf("expect the remaining 10 spans flushed on stop, got %d", n)
+	}
+	if n := atomic.LoadUint64(&globalTracer.dropped); n != 0 {
+		t.Errorf("expect nothing dropped, got %d", n)
+	}
+}
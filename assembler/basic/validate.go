@@ -0,0 +1,191 @@
+package basic
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/peer"
+	"google.golang.org/grpc/codes"
+)
+
+// MaxWeight 节点权重的上限，hash路由为每个权重在环上放一组虚拟节点，过大时启动很慢甚至耗尽内存
+const MaxWeight = 1000
+
+// ValidationError 配置中的所有问题，一次列出
+type ValidationError struct {
+	File     string
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%d problems in %s:\n  - %s", len(e.Problems), e.File, strings.Join(e.Problems, "\n  - "))
+}
+
+// Validate 检查取值范围、文件是否存在以及各项设置能否解析，f只用于错误信息。
+// 没有问题时返回nil，否则返回*ValidationError
+func (c *Config) Validate(f string) error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	node := func(name string, n Node) {
+		if n.Weight < 0 || n.Weight > MaxWeight {
+			add("%s: weight must be within [0, %d], got %d", name, MaxWeight, n.Weight)
+		}
+		if n.Addr == "" {
+			add("%s: addr is empty", name)
+		} else if _, _, err := net.SplitHostPort(n.Addr); err != nil {
+			add("%s: addr %q is not host:port", name, n.Addr)
+		}
+	}
+	file := func(name, path string) {
+		if path == "" {
+			add("%s is empty", name)
+			return
+		}
+		info, err := os.Stat(path)
+		switch {
+		case err != nil:
+			add("%s: %s", name, err)
+		case info.IsDir():
+			add("%s: %s is a directory", name, path)
+		}
+	}
+
+	if len(c.Peers) == 0 {
+		add("peers is empty")
+	}
+	for i, n := range c.Peers {
+		node(fmt.Sprintf("peers[%d]", i), n)
+	}
+	node("orderer", c.Orderer)
+	for _, v := range [][2]string{{"channel", c.Channel}, {"chaincode", c.Chaincode}, {"mspid", c.MSPID}} {
+		if v[1] == "" {
+			add("%s is empty", v[0])
+		}
+	}
+	file("private_key", c.PrivateKey)
+	file("sign_cert", c.SignCert)
+	for i, p := range c.TLSCACerts {
+		file(fmt.Sprintf("tls_ca_certs[%d]", i), p)
+	}
+	if c.NumOfConn <= 0 {
+		add("num_of_conn must be positive, got %d", c.NumOfConn)
+	}
+	if c.ClientPerConn <= 0 {
+		add("client_per_conn must be positive, got %d", c.ClientPerConn)
+	}
+
+	for i, s := range c.Sinks {
+		if _, err := s.GetInterval(); err != nil {
+			add("sinks[%d]: %s", i, err)
+		}
+		switch s.Type {
+		case SinkInfluxHTTP, SinkInfluxUDP, SinkStatsD:
+		default:
+			add("sinks[%d]: unknown type %q", i, s.Type)
+		}
+		if s.Addr == "" {
+			add("sinks[%d]: addr is empty", i)
+		}
+	}
+	if c.Tracing != nil {
+		if c.Tracing.Endpoint == "" {
+			add("tracing: endpoint is empty, remove tracing to disable it")
+		}
+		if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+			add("tracing: sample_ratio must be within [0, 1], got %g", c.Tracing.SampleRatio)
+		}
+	}
+	if c.OperationsInterval != "" {
+		if _, err := c.GetOperationsInterval(); err != nil {
+			add("operations_interval: %s", err)
+		}
+	}
+	if _, err := c.GetRPCTimeout(); err != nil {
+		add("rpc_timeout: %s", err)
+	}
+	if _, _, err := c.Reconnect.GetBackoff(); err != nil {
+		add("broadcast_reconnect: %s", err)
+	}
+	if _, err := c.Reconnect.ResendInFlight(); err != nil {
+		add("broadcast_reconnect: %s", err)
+	}
+	stages := make([]string, 0, len(c.Retry))
+	for stage := range c.Retry {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	for _, stage := range stages {
+		r := c.Retry[stage]
+		if stage != "proposal" && stage != "broadcast" {
+			add("retry: stage must be proposal or broadcast, got %s", stage)
+		} else if _, err := r.Policy(); err != nil {
+			add("retry %s: %s", stage, err)
+		}
+		for _, code := range r.Codes {
+			if !grpcCodes[code] {
+				add("retry %s: unknown gRPC code %s", stage, code)
+			}
+		}
+		for _, st := range r.Statuses {
+			if _, err := strconv.Atoi(st); err != nil {
+				if _, ok := common.Status_value[st]; !ok {
+					add("retry %s: unknown status %s, expecting a number or a common.Status name", stage, st)
+				}
+			}
+		}
+	}
+	if c.Resubmit.MaxAttempts < 0 {
+		add("resubmit: max_attempts must not be negative, got %d", c.Resubmit.MaxAttempts)
+	}
+	for _, code := range c.Resubmit.Codes {
+		if _, ok := peer.TxValidationCode_value[code]; !ok || code == peer.TxValidationCode_VALID.String() {
+			add("resubmit: unknown or valid validation code %s", code)
+		}
+	}
+	for _, v := range [][2]string{{"proposal", c.Routing.Proposal}, {"broadcast", c.Routing.Broadcast}} {
+		if v[1] != "" && !contains(RouteStrategies, v[1]) {
+			add("routing %s: strategy must be one of %s, got %s", v[0], strings.Join(RouteStrategies, ", "), v[1])
+		}
+	}
+	// 启动速度由命令行给出，这里只检查和它无关的部分
+	speed := c.Adaptive.MinRate
+	if c.Adaptive.MaxRate > speed {
+		speed = c.Adaptive.MaxRate
+	}
+	if speed == 0 {
+		speed = 1
+	}
+	if _, err := c.Adaptive.Controller(speed); err != nil {
+		add("adaptive_rate: %s", err)
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return &ValidationError{File: f, Problems: problems}
+}
+
+// grpcCodes gRPC状态码的名字，如Unavailable
+var grpcCodes = func() map[string]bool {
+	names := make(map[string]bool)
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		names[c.String()] = true
+	}
+	return names
+}()
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package basic
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// validConfig 文件都存在、没有任何问题的配置
+func validConfig(t *testing.T, dir string) *Config {
+	path := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(path, []byte("pem"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &Config{
+		Peers:         []Node{{Addr: "peer0:7051"}},
+		Orderer:       Node{Addr: "orderer:7050"},
+		Channel:       "mychannel",
+		Chaincode:     "mycc",
+		MSPID:         "Org1MSP",
+		PrivateKey:    path,
+		SignCert:      path,
+		NumOfConn:     1,
+		ClientPerConn: 1,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stupid-validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name     string
+		modify   func(c *Config)
+		problems []string // 每一项都应出现在错误中，数量也要一致
+	}{
+		{"valid", func(c *Config) {}, nil},
+		{"several problems at once", func(c *Config) {
+			c.Channel = ""
+			c.NumOfConn = 0
+			c.Orderer.Addr = "orderer"
+			c.Sinks = []SinkConfig{{Type: SinkStatsD}}
+			c.Tracing = &TraceConfig{SampleRatio: 2}
+		}, []string{
+			"orderer: addr \"orderer\" is not host:port",
+			"channel is empty",
+			"num_of_conn must be positive",
+			"sinks[0]: addr is empty",
+			"tracing: endpoint is empty",
+			"tracing: sample_ratio must be within [0, 1]",
+		}},
+		{"weights", func(c *Config) {
+			c.Peers = append(c.Peers, Node{Addr: "peer1:7051", Weight: MaxWeight}, Node{Addr: "peer2:7051", Weight: 100000000})
+			c.Orderer.Weight = -1
+		}, []string{
+			"peers[2]: weight must be within [0, 1000], got 100000000",
+			"orderer: weight must be within [0, 1000], got -1",
+		}},
+		{"retry codes and statuses", func(c *Config) {
+			c.Retry = map[string]RetryConfig{
+				"proposal":  {MaxAttempts: 3, Codes: []string{"Unavailable", "Unavaliable"}, Statuses: []string{"500", "INTERNAL_SERVER_ERROR", "TIMEOUT"}},
+				"broadcast": {MaxAttempts: 2, Codes: []string{"DeadlineExceeded"}, Statuses: []string{"SERVICE_UNAVAILABLE"}},
+			}
+		}, []string{
+			"retry proposal: unknown gRPC code Unavaliable",
+			"retry proposal: unknown status TIMEOUT",
+		}},
+		{"missing files", func(c *Config) {
+			c.SignCert = filepath.Join(dir, "missing.pem")
+			c.TLSCACerts = []string{dir}
+		}, []string{
+			"sign_cert:",
+			"tls_ca_certs[0]: " + dir + " is a directory",
+		}},
+	}
+
+	for _, c := range cases {
+		config := validConfig(t, dir)
+		c.modify(config)
+		err := config.Validate("config.json")
+		if len(c.problems) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", c.name, err)
+			}
+			continue
+		}
+		v, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("%s: expect *ValidationError, got %v", c.name, err)
+			continue
+		}
+		if len(v.Problems) != len(c.problems) {
+			t.Errorf("%s: expect %d problems, got %d:\n%s", c.name, len(c.problems), len(v.Problems), err)
+		}
+		for _, p := range c.problems {
+			if !strings.Contains(err.Error(), p) {
+				t.Errorf("%s: %q not reported in:\n%s", c.name, p, err)
+			}
+		}
+	}
+}
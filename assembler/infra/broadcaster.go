@@ -1,76 +1,369 @@
 package infra
 
 import (
-	"fmt"
+	"context"
 	"github.com/hcg1314/stupid/assembler/basic"
 	"github.com/hyperledger/fabric/protos/common"
 	"github.com/hyperledger/fabric/protos/orderer"
+	"github.com/pkg/errors"
 	"io"
+	"sync/atomic"
+	"time"
 )
 
+// 已发送、等待orderer应答的交易，orderer按发送顺序应答
+type inflight struct {
+	e       *Elements
+	sent    time.Time
+	attempt int // 第几次尝试，从1开始
+}
+
+// stream 一次建立的broadcast流，断开后整体丢弃，重新建立
+type stream struct {
+	c        orderer.AtomicBroadcast_BroadcastClient
+	cancel   context.CancelFunc // 关闭流和它的连接
+	inflight chan inflight
+	end      chan error // startDraining退出的原因，正常结束为io.EOF
+}
+
+// dialBroadcast 建立到orderer的broadcast流，测试中替换为假的orderer
+var dialBroadcast = CreateBroadcastClient
+
 type broadcaster struct {
-	c    orderer.AtomicBroadcast_BroadcastClient
-	envs chan *Elements
+	ctx   context.Context
+	node  basic.Node
+	certs [][]byte
+	s     *stream // 只在Start中使用
+	envs  chan *Elements
+	retry chan inflight  // 等待重发的交易
+	peers []*broadcaster // 同一个Dispatcher中的所有broadcaster，重试时换一个连接
+	next  uint32         // atomic，轮流选择重试的broadcaster
+
+	// 交给这个broadcaster、还没有最终结果的交易数，atomic。
+	// envs关闭后它降为0时才结束发送，避免丢掉等待重试的交易；结束发送后置为-1，不再接收重试
+	pending int64
+	idle    chan struct{}
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	resend     bool // 重连后重发没有收到应答的交易，否则计为丢失
+	policy     *basic.RetryPolicy
+
+	stat *endpointStat
 }
 
-func CreateBroadcaster(node basic.Node, crypto *basic.Crypto) *broadcaster {
-	client, err := CreateBroadcastClient(node, crypto.TLSCACerts)
+func CreateBroadcaster(ctx context.Context, node basic.Node, crypto *basic.Crypto, conn int, reconnect basic.ReconnectConfig, retry *basic.RetryPolicy) (*broadcaster, error) {
+	minBackoff, maxBackoff, err := reconnect.GetBackoff()
 	if err != nil {
-		panic(err)
+		return nil, basic.WrapError(basic.ErrConfig, err, "broadcast_reconnect")
+	}
+	resend, err := reconnect.ResendInFlight()
+	if err != nil {
+		return nil, basic.WrapError(basic.ErrConfig, err, "broadcast_reconnect")
 	}
 
-	return &broadcaster{
-		c:    client,
-		envs: make(chan *Elements, 1000),
+	b := &broadcaster{
+		ctx:        ctx,
+		node:       node,
+		certs:      crypto.TLSCACerts,
+		envs:       make(chan *Elements, 1000),
+		retry:      make(chan inflight, 1000),
+		idle:       make(chan struct{}, 1),
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+		resend:     resend,
+		policy:     retry,
+		stat:       newBroadcastStat(node.Addr, conn),
+	}
+	if b.s, err = b.connect(); err != nil {
+		return nil, basic.WrapError(basic.ErrConnection, err, "connect to orderer %s", node.Addr)
 	}
+	return b, nil
+}
+
+func (b *broadcaster) connect() (*stream, error) {
+	ctx, cancel := context.WithCancel(b.ctx)
+	client, err := dialBroadcast(ctx, b.node, b.certs)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &stream{
+		c:        client,
+		cancel:   cancel,
+		inflight: make(chan inflight, 10000),
+		end:      make(chan error, 1),
+	}, nil
 }
 
 func (b *broadcaster) Handle(e *Elements) error {
-	b.envs <- e
-	return nil
+	select {
+	case b.envs <- e:
+		return nil
+	case <-b.ctx.Done():
+		return b.ctx.Err()
+	}
+}
+
+func (b *broadcaster) Close() {
+	close(b.envs)
 }
 
 func (b *broadcaster) GetWait() int {
 	return len(b.envs)
 }
 
+func (b *broadcaster) GetCap() int {
+	return cap(b.envs)
+}
+
+func (b *broadcaster) endpoint() *endpointStat {
+	return b.stat
+}
+
+// Start envs被关闭、所有交易都有了最终结果后结束发送，startDraining收完应答后退出；
+// 流断开时重连，ctx取消时stream随之关闭，两边都立即退出
 func (b *broadcaster) Start() {
-	go b.startDraining()
+	go b.startDraining(b.s)
+	rec := basic.NewRecorder()
+	envs := b.envs
+	closing := false
+	finish := func() {
+		if envs == nil && !closing && (atomic.LoadInt64(&b.pending) < 0 || atomic.CompareAndSwapInt64(&b.pending, 0, -1)) {
+			_ = b.s.c.CloseSend()
+			closing = true
+		}
+	}
 	for {
 		select {
-		case e,ok := <-b.envs:
+		case e, ok := <-envs:
 			if !ok {
+				// 不再有新的交易，等待已发送交易的结果
+				envs = nil
+				finish()
+				continue
+			}
+			atomic.AddInt64(&b.pending, 1)
+			if !b.send(inflight{e: e, attempt: 1}, rec) {
+				return
+			}
+		case f := <-b.retry:
+			if !b.send(f, rec) {
 				return
 			}
-			basic.AddTotal(basic.ItemBroadcast)
-			err := b.c.Send(e.Envelope)
-			if err != nil {
-				basic.AddFail(basic.ItemBroadcast)
-				GlobalObserver.AddFailed()
-				fmt.Printf("Failed to broadcast env: %s\n", err)
+		case <-b.idle:
+			finish()
+		case err := <-b.s.end:
+			if closing && err == io.EOF {
+				return
 			}
+			if !b.reconnect(err, rec) {
+				return
+			}
+			closing = false
+			finish()
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+// send 在当前流上发送，发送失败说明流已经断开，重连后返回
+func (b *broadcaster) send(f inflight, rec *basic.Recorder) bool {
+	rec.AddTotal(basic.ItemBroadcast)
+	b.stat.total.Inc()
+	// 先登记再发送，避免区块先于登记到达
+	GlobalObserver.Track(f.e)
+	f.sent = time.Now()
+	if err := b.s.c.Send(f.e.Envelope); err != nil {
+		// 真正的原因由Recv返回
+		b.s.cancel()
+		return b.reconnect(<-b.s.end, rec, f)
+	}
+	select {
+	case b.s.inflight <- f:
+		return true
+	case <-b.ctx.Done():
+		return false
+	}
+}
+
+// finished 一个交易有了最终结果
+func (b *broadcaster) finished() {
+	if atomic.AddInt64(&b.pending, -1) == 0 {
+		select {
+		case b.idle <- struct{}{}:
+		default:
 		}
 	}
 }
 
-func (b *broadcaster) startDraining() {
+// reconnect 丢弃断开的流，按退避重新建立，然后重发或者丢弃没有收到应答的交易。
+// 调用时startDraining已经退出，ctx取消时返回false
+func (b *broadcaster) reconnect(cause error, rec *basic.Recorder, unacked ...inflight) bool {
+	if b.ctx.Err() != nil {
+		return false
+	}
 	for {
-		res, err := b.c.Recv()
+		b.s.cancel()
+		// startDraining已退出，剩下的都没有收到应答，按发送顺序排在前面
+		pending := make([]inflight, 0, len(b.s.inflight)+len(unacked))
+		for len(b.s.inflight) > 0 {
+			pending = append(pending, <-b.s.inflight)
+		}
+		unacked = append(pending, unacked...)
+		if cause == io.EOF {
+			cause = errors.New("stream closed by orderer")
+		}
+		basic.RecordError(b.stat.stage, b.stat.addr, errors.Wrap(cause, "broadcast stream broken"))
+		basic.Logf("broadcast stream to %s broken with %d tx in flight: %s, reconnecting", b.stat.addr, len(unacked), cause)
+
+		s, err := b.redial()
 		if err != nil {
-			if err == io.EOF {
-				return
+			return false
+		}
+		b.s = s
+		b.stat.reconnects.Inc()
+		go b.startDraining(s)
+
+		if !b.resend {
+			for _, f := range unacked {
+				b.lose(f, cause, rec)
 			}
+			return true
+		}
+		var i int
+		for i = 0; i < len(unacked); i++ {
+			f := unacked[i]
+			f.sent = time.Now()
+			if err = s.c.Send(f.e.Envelope); err != nil {
+				break
+			}
+			b.stat.resent.Inc()
+			select {
+			case s.inflight <- f:
+			case <-b.ctx.Done():
+				return false
+			}
+		}
+		if i == len(unacked) {
+			return true
+		}
+		// 重发时又断开了
+		s.cancel()
+		cause = <-s.end
+		unacked = unacked[i:]
+	}
+}
 
-			fmt.Printf("Recv broadcast err: %s, status: %+v\n", err, res)
-			panic("bcast recv err")
+// redial 按指数退避重试直到建立新的流，ctx取消时返回错误
+func (b *broadcaster) redial() (*stream, error) {
+	backoff := b.minBackoff
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-b.ctx.Done():
+			return nil, b.ctx.Err()
+		}
+		s, err := b.connect()
+		if err == nil {
+			return s, nil
+		}
+		basic.RecordError(b.stat.stage, b.stat.addr, err)
+		if backoff *= 2; backoff > b.maxBackoff {
+			backoff = b.maxBackoff
 		}
+	}
+}
+
+// lose 断流时没有收到应答、也不重发的交易计为失败
+func (b *broadcaster) lose(f inflight, cause error, rec *basic.Recorder) {
+	err := errors.Wrap(cause, "lost in broken stream")
+	f.e.Trace.Span("broadcast", b.stat.addr, f.attempt, f.sent, time.Now(), "", err)
+	f.e.Trace.Finish("", err)
+	rec.AddFail(basic.ItemBroadcast)
+	b.stat.failures.Inc()
+	b.stat.lost.Inc()
+	GlobalObserver.Untrack(f.e.TxID)
+	GlobalObserver.AddFailed()
+	b.finished()
+}
+
+// startDraining 接收s上的应答，出错或者流结束时把原因写到s.end后退出
+func (b *broadcaster) startDraining(s *stream) {
+	rec := basic.NewRecorder()
+	for {
+		res, err := s.c.Recv()
+		if err != nil {
+			s.end <- err
+			return
+		}
+
+		f := <-s.inflight
+		end := time.Now()
+		b.stat.observe(end.Sub(f.sent).Seconds())
 
 		if res.Status != common.Status_SUCCESS {
-			basic.AddFail(basic.ItemBroadcast)
+			err = errors.New(res.Info)
+			f.e.Trace.Span("broadcast", b.stat.addr, f.attempt, f.sent, end, res.Status.String(), err)
+			basic.RecordStatus(b.stat.stage, b.stat.addr, int32(res.Status), res.Status.String()+" "+res.Info)
+			if b.policy.RetryStatus(f.attempt, int32(res.Status), res.Status.String()) {
+				rec.AddRetry(basic.ItemBroadcast)
+				b.stat.retried.Inc()
+				b.retryLater(f)
+				continue
+			}
+			f.e.Trace.Finish(res.Status.String(), err)
+			rec.AddFail(basic.ItemBroadcast)
+			b.stat.failures.Inc()
+			GlobalObserver.Untrack(f.e.TxID)
 			GlobalObserver.AddFailed()
-			fmt.Printf("Recv errouneous status: %s\n", res.Status)
+			b.finished()
 			continue
 		}
-		basic.AddSuccess(basic.ItemBroadcast)
+		f.e.Trace.Span("broadcast", b.stat.addr, f.attempt, f.sent, end, res.Status.String(), nil)
+		rec.AddSuccess(basic.ItemBroadcast)
+		b.stat.success.Inc()
+		b.finished()
+	}
+}
+
+// retryLater 等待退避时间后交给另一个连接重发，只有一个连接或者其它连接都已结束时在原连接上重发
+func (b *broadcaster) retryLater(f inflight) {
+	f.attempt++
+	time.AfterFunc(b.policy.Backoff, func() {
+		target := b.alternative()
+		if target != b {
+			b.finished()
+		}
+		select {
+		case target.retry <- f:
+		case <-b.ctx.Done():
+		}
+	})
+}
+
+// alternative 轮流选择另一个还在发送的broadcaster并为它登记一个待定交易
+func (b *broadcaster) alternative() *broadcaster {
+	n := len(b.peers)
+	start := int(atomic.AddUint32(&b.next, 1))
+	for i := 0; i < n; i++ {
+		if c := b.peers[(start+i)%n]; c != b && c.accept() {
+			return c
+		}
+	}
+	return b
+}
+
+// accept 结束发送后返回false
+func (b *broadcaster) accept() bool {
+	for {
+		n := atomic.LoadInt64(&b.pending)
+		if n < 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.pending, n, n+1) {
+			return true
+		}
 	}
 }
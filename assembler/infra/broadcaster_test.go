@@ -0,0 +1,294 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"github.com/hcg1314/stupid/assembler/basic"
+	"github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/orderer"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// streamScript 一个流的行为：只应答前acks个交易(-1为全部应答)，收到第breakAt个交易后断开(0为不断开)
+type streamScript struct {
+	acks    int
+	breakAt int
+}
+
+// fakeOrderer 每建立一个流按顺序取一个脚本，脚本用完后的流都正常应答
+type fakeOrderer struct {
+	lock    sync.Mutex
+	scripts []streamScript
+	streams int
+	reject  map[string]int // 交易前几次返回SERVICE_UNAVAILABLE
+	acked   map[string]int // 交易收到成功应答的次数
+}
+
+func newFakeOrderer(scripts ...streamScript) *fakeOrderer {
+	return &fakeOrderer{scripts: scripts, reject: make(map[string]int), acked: make(map[string]int)}
+}
+
+func (o *fakeOrderer) dial(ctx context.Context, node basic.Node, certs [][]byte) (orderer.AtomicBroadcast_BroadcastClient, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	s := &fakeStream{
+		o:      o,
+		ctx:    ctx,
+		script: streamScript{acks: -1},
+		acks:   make(chan *orderer.BroadcastResponse, 10000),
+		broken: make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+	if o.streams < len(o.scripts) {
+		s.script = o.scripts[o.streams]
+	}
+	o.streams++
+	return s, nil
+}
+
+func (o *fakeOrderer) respond(txid string) *orderer.BroadcastResponse {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.reject[txid] > 0 {
+		o.reject[txid]--
+		return &orderer.BroadcastResponse{Status: common.Status_SERVICE_UNAVAILABLE, Info: "try later"}
+	}
+	o.acked[txid]++
+	return &orderer.BroadcastResponse{Status: common.Status_SUCCESS}
+}
+
+// fakeStream Send只在broadcaster的Start中调用，Recv只在startDraining中调用
+type fakeStream struct {
+	grpc.ClientStream // broadcaster不用的方法
+
+	o         *fakeOrderer
+	ctx       context.Context
+	script    streamScript
+	received  int
+	acks      chan *orderer.BroadcastResponse
+	broken    chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Send 和gRPC相同，流断开后返回io.EOF，原因由Recv返回
+func (s *fakeStream) Send(env *common.Envelope) error {
+	select {
+	case <-s.broken:
+		return io.EOF
+	case <-s.ctx.Done():
+		return io.EOF
+	default:
+	}
+	s.received++
+	if s.script.acks < 0 || s.received <= s.script.acks {
+		s.acks <- s.o.respond(string(env.Payload))
+	}
+	if s.received == s.script.breakAt {
+		close(s.broken)
+	}
+	return nil
+}
+
+// Recv 先返回断开之前的应答
+func (s *fakeStream) Recv() (*orderer.BroadcastResponse, error) {
+	select {
+	case r := <-s.acks:
+		return r, nil
+	default:
+	}
+	select {
+	case r := <-s.acks:
+		return r, nil
+	case <-s.broken:
+		return nil, errors.New("connection reset by orderer")
+	case <-s.closed:
+		return nil, io.EOF
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+func (s *fakeStream) CloseSend() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+// runBroadcasters 用o建立n个broadcaster，轮流交给它们txs个交易后关闭，等待它们的Start都退出，
+// 返回这期间所有连接的统计之和
+func runBroadcasters(t *testing.T, o *fakeOrderer, addr string, n, txs int, reconnect basic.ReconnectConfig, policy *basic.RetryPolicy) broadcastCounts {
+	defer func(dial func(context.Context, basic.Node, [][]byte) (orderer.AtomicBroadcast_BroadcastClient, error)) {
+		dialBroadcast = dial
+	}(dialBroadcast)
+	dialBroadcast = o.dial
+	// 重连的日志对测试没有用
+	defer basic.SetLogOutput(basic.SetLogOutput(ioutil.Discard))
+	GlobalObserver = newObserver(nil, addr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broadcasters := make([]*broadcaster, n)
+	for i := range broadcasters {
+		b, err := CreateBroadcaster(ctx, basic.Node{Addr: addr}, &basic.Crypto{}, i, reconnect, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		broadcasters[i] = b
+	}
+	// 统计按地址和连接全局登记，-count多次运行时累加
+	before := countBroadcasts(broadcasters)
+	var wg sync.WaitGroup
+	for _, b := range broadcasters {
+		b.peers = broadcasters
+		wg.Add(1)
+		go func(b *broadcaster) {
+			defer wg.Done()
+			b.Start()
+		}(b)
+	}
+
+	for i := 0; i < txs; i++ {
+		txid := fmt.Sprintf("tx%d", i)
+		_ = broadcasters[i%n].Handle(&Elements{TxID: txid, Envelope: &common.Envelope{Payload: []byte(txid)}})
+	}
+	for _, b := range broadcasters {
+		b.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		for _, b := range broadcasters {
+			t.Logf("%s conn %d: pending %d", addr, b.stat.conn, atomic.LoadInt64(&b.pending))
+		}
+		t.Fatal("broadcasters did not finish, pending transactions leaked")
+	}
+	for _, b := range broadcasters {
+		if n := atomic.LoadInt64(&b.pending); n != -1 {
+			t.Errorf("conn %d: expect pending -1 after finishing, got %d", b.stat.conn, n)
+		}
+	}
+	after := countBroadcasts(broadcasters)
+	return broadcastCounts{
+		total:      after.total - before.total,
+		success:    after.success - before.success,
+		failures:   after.failures - before.failures,
+		retried:    after.retried - before.retried,
+		reconnects: after.reconnects - before.reconnects,
+		resent:     after.resent - before.resent,
+		lost:       after.lost - before.lost,
+	}
+}
+
+type broadcastCounts struct {
+	total, success, failures, retried, reconnects, resent, lost uint64
+}
+
+func countBroadcasts(broadcasters []*broadcaster) broadcastCounts {
+	var c broadcastCounts
+	for _, b := range broadcasters {
+		c.total += b.stat.total.Get()
+		c.success += b.stat.success.Get()
+		c.failures += b.stat.failures.Get()
+		c.retried += b.stat.retried.Get()
+		c.reconnects += b.stat.reconnects.Get()
+		c.resent += b.stat.resent.Get()
+		c.lost += b.stat.lost.Get()
+	}
+	return c
+}
+
+// checkAcked 每个交易至多收到一次成功应答，返回收到应答的交易数
+func checkAcked(t *testing.T, o *fakeOrderer) uint64 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for txid, n := range o.acked {
+		if n != 1 {
+			t.Errorf("%s acknowledged %d times", txid, n)
+		}
+	}
+	return uint64(len(o.acked))
+}
+
+func fastReconnect(inFlight string) basic.ReconnectConfig {
+	return basic.ReconnectConfig{MinBackoff: "1ms", MaxBackoff: "10ms", InFlight: inFlight}
+}
+
+// 流断开时没有应答的交易计为丢失，不会再发送，也不会计为成功
+func TestBroadcasterLoseInFlight(t *testing.T) {
+	o := newFakeOrderer(streamScript{acks: 3, breakAt: 5})
+	c := runBroadcasters(t, o, "orderer-lost:7050", 1, 10, fastReconnect(basic.InFlightLost), nil)
+	if c.reconnects != 1 || c.resent != 0 {
+		t.Errorf("expect 1 reconnect without resending, got %+v", c)
+	}
+	if c.lost < 2 || c.failures != c.lost || c.success+c.lost != 10 || c.total != 10 {
+		t.Errorf("expect at least the 2 unacknowledged tx lost and the rest succeeded, got %+v", c)
+	}
+	if acked := checkAcked(t, o); acked != c.success {
+		t.Errorf("orderer acknowledged %d tx, broadcaster counted %d", acked, c.success)
+	}
+	if failed := atomic.LoadUint64(&GlobalObserver.failed); failed != c.lost {
+		t.Errorf("observer counted %d failed, expect %d", failed, c.lost)
+	}
+	if n := len(GlobalObserver.pending); uint64(n) != c.success {
+		t.Errorf("lost tx still tracked: %d tracked, %d succeeded", n, c.success)
+	}
+}
+
+// 重连后重发没有应答的交易，每个交易只成功一次
+func TestBroadcasterResendInFlight(t *testing.T) {
+	o := newFakeOrderer(streamScript{acks: 3, breakAt: 5})
+	c := runBroadcasters(t, o, "orderer-resend:7050", 1, 10, fastReconnect(basic.InFlightResend), nil)
+	if c.reconnects != 1 || c.resent < 2 || c.success != 10 || c.failures != 0 || c.total != 10 {
+		t.Errorf("expect every tx succeeded once after resending, got %+v", c)
+	}
+	if acked := checkAcked(t, o); acked != 10 {
+		t.Errorf("expect 10 tx acknowledged, got %d", acked)
+	}
+}
+
+// 重发时流再次断开，已重发和还没重发的交易在下一个流上继续重发
+func TestBroadcasterBreakDuringResend(t *testing.T) {
+	o := newFakeOrderer(streamScript{acks: 3, breakAt: 5}, streamScript{acks: 0, breakAt: 1})
+	c := runBroadcasters(t, o, "orderer-rebreak:7050", 1, 10, fastReconnect(basic.InFlightResend), nil)
+	if c.reconnects != 2 || c.success != 10 || c.failures != 0 || c.lost != 0 || c.total != 10 {
+		t.Errorf("expect every tx succeeded once after 2 reconnects, got %+v", c)
+	}
+	if acked := checkAcked(t, o); acked != 10 {
+		t.Errorf("expect 10 tx acknowledged, got %d", acked)
+	}
+}
+
+// 返回可重试状态的交易换一个连接重发，超过次数后计为失败，待定数不泄漏
+func TestBroadcasterRetryOnAnotherConn(t *testing.T) {
+	o := newFakeOrderer()
+	o.reject["tx1"] = 1
+	o.reject["tx4"] = 2
+	o.reject["tx7"] = 3
+	policy, err := basic.RetryConfig{MaxAttempts: 3, Backoff: "1ms", Statuses: []string{"SERVICE_UNAVAILABLE"}}.Policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := runBroadcasters(t, o, "orderer-retry:7050", 2, 10, fastReconnect(basic.InFlightLost), policy)
+	if c.retried != 5 || c.success != 9 || c.failures != 1 || c.total != 15 {
+		t.Errorf("expect 5 retries, 9 succeeded and tx7 failed, got %+v", c)
+	}
+	if acked := checkAcked(t, o); acked != 9 {
+		t.Errorf("expect 9 tx acknowledged, got %d", acked)
+	}
+	if failed := atomic.LoadUint64(&GlobalObserver.failed); failed != 1 {
+		t.Errorf("observer counted %d failed, expect 1", failed)
+	}
+}
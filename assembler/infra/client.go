@@ -8,6 +8,7 @@ import (
 	"github.com/hyperledger/fabric/core/comm"
 	"github.com/hyperledger/fabric/protos/orderer"
 	"github.com/hyperledger/fabric/protos/peer"
+	"google.golang.org/grpc"
 )
 
 func CreateGRPCClient(certs [][]byte) (*comm.GRPCClient, error) {
@@ -31,7 +32,15 @@ func CreateGRPCClient(certs [][]byte) (*comm.GRPCClient, error) {
 	return grpcClient, nil
 }
 
-func CreateEndorserClient(node basic.Node, tlscacerts [][]byte) (peer.EndorserClient, error) {
+// closeOnDone ctx取消后关闭连接
+func closeOnDone(ctx context.Context, conn *grpc.ClientConn) {
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+}
+
+func CreateEndorserClient(ctx context.Context, node basic.Node, tlscacerts [][]byte) (peer.EndorserClient, error) {
 	gRPCClient, err := CreateGRPCClient(tlscacerts)
 	if err != nil {
 		return nil, err
@@ -41,11 +50,12 @@ func CreateEndorserClient(node basic.Node, tlscacerts [][]byte) (peer.EndorserCl
 	if err != nil {
 		return nil, err
 	}
+	closeOnDone(ctx, conn)
 
 	return peer.NewEndorserClient(conn), nil
 }
 
-func CreateBroadcastClient(node basic.Node, tlscacerts [][]byte) (orderer.AtomicBroadcast_BroadcastClient, error) {
+func CreateBroadcastClient(ctx context.Context, node basic.Node, tlscacerts [][]byte) (orderer.AtomicBroadcast_BroadcastClient, error) {
 	gRPCClient, err := CreateGRPCClient(tlscacerts)
 	if err != nil {
 		return nil, err
@@ -55,11 +65,12 @@ func CreateBroadcastClient(node basic.Node, tlscacerts [][]byte) (orderer.Atomic
 	if err != nil {
 		return nil, err
 	}
+	closeOnDone(ctx, conn)
 
-	return orderer.NewAtomicBroadcastClient(conn).Broadcast(context.Background())
+	return orderer.NewAtomicBroadcastClient(conn).Broadcast(ctx)
 }
 
-func CreateDeliverFilteredClient(node basic.Node, tlscacerts [][]byte) (peer.Deliver_DeliverFilteredClient, error) {
+func CreateDeliverFilteredClient(ctx context.Context, node basic.Node, tlscacerts [][]byte) (peer.Deliver_DeliverFilteredClient, error) {
 	gRPCClient, err := CreateGRPCClient(tlscacerts)
 	if err != nil {
 		return nil, err
@@ -69,6 +80,7 @@ func CreateDeliverFilteredClient(node basic.Node, tlscacerts [][]byte) (peer.Del
 	if err != nil {
 		return nil, err
 	}
+	closeOnDone(ctx, conn)
 
-	return peer.NewDeliverClient(conn).DeliverFiltered(context.Background())
+	return peer.NewDeliverClient(conn).DeliverFiltered(ctx)
 }
@@ -1,95 +1,186 @@
 package infra
 
 import (
+	"context"
 	"github.com/hcg1314/stupid/assembler/basic"
+	"sync"
+	"time"
+
 	"github.com/hyperledger/fabric/protos/common"
 	"github.com/hyperledger/fabric/protos/peer"
 )
 
 type Elements struct {
+	TxID       string
+	Intended   time.Time // 按目标速度计划的发送时间
+	Start      time.Time // 提案实际创建的时间
 	Proposal   *peer.Proposal
 	SignedProp *peer.SignedProposal
 	Response   *peer.ProposalResponse
 	Envelope   *common.Envelope
+	Trace      *basic.Trace // 未被采样时为nil
+	Op         Operation
+}
+
+// Operation 一个交易对应的业务操作，验证失效后重做时用新的交易提交同一个操作
+type Operation struct {
+	Key     string
+	Attempt int       // 第几次提交，从1开始
+	First   time.Time // 第一次提交时创建提案的时间
 }
 
+// Handler 处理分发过来的交易，Close之后不再调用Handle
 type Handler interface {
 	Handle(e *Elements) error
 	GetWait() int
+	GetCap() int
+	Close()
+	endpoint() *endpointStat // 路由需要的时延以及分配数的统计
 }
 
+// Dispatcher 输入被Close或者ctx取消后，关闭所有handler，
+// 等写output的goroutine都退出后再关闭output
 type Dispatcher struct {
+	ctx          context.Context
 	input        chan *Elements
 	output       chan *Elements
 	handlers     []Handler
 	handlerCount int
+	router       Router
+	workers      sync.WaitGroup // 写output的goroutine
 }
 
-func CreateProposalDispatcher(conn, client int, nodes []basic.Node, crypto *basic.Crypto) *Dispatcher {
+// weightsOf 每个连接的权重，和节点的权重相同，默认为1
+func weightsOf(nodes []basic.Node, conn int) []int {
+	weights := make([]int, 0, len(nodes)*conn)
+	for _, n := range nodes {
+		w := n.Weight
+		if w <= 0 {
+			w = 1
+		}
+		for i := 0; i < conn; i++ {
+			weights = append(weights, w)
+		}
+	}
+	return weights
+}
+
+// CreateProposalDispatcher 连接失败时返回错误，已建立的连接在ctx取消时关闭。routing为路由策略的名字
+func CreateProposalDispatcher(ctx context.Context, conn, client int, nodes []basic.Node, crypto *basic.Crypto, timeout time.Duration, retry *basic.RetryPolicy, routing string) (*Dispatcher, error) {
+	router, err := NewRouter(routing, weightsOf(nodes, conn))
+	if err != nil {
+		return nil, basic.WrapError(basic.ErrConfig, err, "proposal routing")
+	}
 
 	count := conn * len(nodes) // peer节点数*每个节点的tcp连接数
 	dispatch := &Dispatcher{
+		ctx:          ctx,
 		input:        make(chan *Elements, 1000),
 		output:       make(chan *Elements, 1000),
 		handlerCount: count,
 		handlers:     make([]Handler, count),
+		router:       router,
 	}
 
-	index := 0
+	proposers := make([]*proposer, 0, count)
 	for _, node := range nodes {
 		for i := 0; i < conn; i++ {
-			proposer := CreateProposer(node, crypto, client)
-			proposer.Start(dispatch.output)
-			dispatch.handlers[index] = proposer
-			index += 1
+			proposer, err := CreateProposer(ctx, node, crypto, client, i, timeout, retry)
+			if err != nil {
+				return nil, err
+			}
+			proposers = append(proposers, proposer)
 		}
 	}
+	// 全部连接建立后再启动，重试时可以换到任意一个proposer
+	for i, proposer := range proposers {
+		proposer.peers = proposers
+		proposer.Start(dispatch.output, &dispatch.workers)
+		dispatch.handlers[i] = proposer
+	}
 
-	return dispatch
+	return dispatch, nil
 }
 
-func CreateBroadcastDispatcher(conn int, node basic.Node, crypto *basic.Crypto) *Dispatcher {
+func CreateBroadcastDispatcher(ctx context.Context, conn int, node basic.Node, crypto *basic.Crypto, reconnect basic.ReconnectConfig, retry *basic.RetryPolicy, routing string) (*Dispatcher, error) {
+	router, err := NewRouter(routing, weightsOf([]basic.Node{node}, conn))
+	if err != nil {
+		return nil, basic.WrapError(basic.ErrConfig, err, "broadcast routing")
+	}
+
 	dispatch := &Dispatcher{
+		ctx:          ctx,
 		input:        make(chan *Elements, 1000),
 		output:       nil,
 		handlerCount: conn,
 		handlers:     make([]Handler, conn),
+		router:       router,
 	}
 
+	broadcasters := make([]*broadcaster, 0, conn)
 	for i := 0; i < conn; i++ {
-		broadcaster := CreateBroadcaster(node, crypto)
+		broadcaster, err := CreateBroadcaster(ctx, node, crypto, i, reconnect, retry)
+		if err != nil {
+			return nil, err
+		}
+		broadcasters = append(broadcasters, broadcaster)
+	}
+	// 和proposer相同，全部连接建立后再启动，重试时可以换到任意一个broadcaster
+	for i, broadcaster := range broadcasters {
+		broadcaster.peers = broadcasters
 		go broadcaster.Start()
 		dispatch.handlers[i] = broadcaster
 	}
 
-	return dispatch
+	return dispatch, nil
 }
 
+// Start 按路由策略把输入分给各个handler
 func (d *Dispatcher) Start() {
-	index := 0
+	defer d.close()
 	for {
 		select {
 		case msg, ok := <-d.input:
 			if !ok {
 				return
 			}
-			if index >= d.handlerCount {
-				index = 0
-			}
-
-			_ = d.handlers[index].Handle(msg)
-			index += 1
+			h := d.handlers[d.router.Route(msg, d.handlers)]
+			h.endpoint().routed.Inc()
+			_ = h.Handle(msg)
+		case <-d.ctx.Done():
+			return
 		}
 	}
 }
 
-func (d *Dispatcher) Send(e *Elements) {
-	d.input <- e
+func (d *Dispatcher) close() {
+	for _, h := range d.handlers {
+		h.Close()
+	}
+	if d.output != nil {
+		d.workers.Wait()
+		close(d.output)
+	}
+}
+
+// Send ctx取消后丢弃e，返回false
+func (d *Dispatcher) Send(e *Elements) bool {
+	select {
+	case d.input <- e:
+		return true
+	case <-d.ctx.Done():
+		return false
+	}
+}
+
+// Close 上游不再发送时调用，Dispatcher处理完输入后依次关闭下游
+func (d *Dispatcher) Close() {
+	close(d.input)
 }
 
 func (d *Dispatcher) GetWaitCount() int {
 	count := 0
-	for _,h := range d.handlers {
+	for _, h := range d.handlers {
 		count += h.GetWait()
 	}
 	return count
@@ -98,3 +189,20 @@ func (d *Dispatcher) GetWaitCount() int {
 func (d *Dispatcher) GetOutput() chan *Elements {
 	return d.output
 }
+
+// GetChannels 返回输入、输出以及最满的handler队列的填充情况，name为handler队列的名字。
+// 输入只是转发给handler，handler队列满时它也会满，所以不算本地消费
+func (d *Dispatcher) GetChannels(stage, name string) []basic.ChannelFill {
+	channels := []basic.ChannelFill{{Name: stage + ".input", Len: len(d.input), Cap: cap(d.input)}}
+	if d.output != nil {
+		channels = append(channels, basic.ChannelFill{Name: stage + ".output", Len: len(d.output), Cap: cap(d.output), Local: true})
+	}
+	fullest := basic.ChannelFill{Name: stage + "." + name}
+	for _, h := range d.handlers {
+		c := basic.ChannelFill{Name: fullest.Name, Len: h.GetWait(), Cap: h.GetCap()}
+		if c.Ratio() >= fullest.Ratio() {
+			fullest = c
+		}
+	}
+	return append(channels, fullest)
+}
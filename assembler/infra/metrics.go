@@ -0,0 +1,218 @@
+package infra
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hcg1314/stupid/assembler/basic"
+)
+
+var (
+	proposalTotal     = basic.NewCounterVec("stupid_proposals_total", "Number of proposals sent to peer.", "peer", "conn")
+	proposalSuccesses = basic.NewCounterVec("stupid_proposal_successes_total", "Number of proposals endorsed by peer.", "peer", "conn")
+	proposalFailures  = basic.NewCounterVec("stupid_proposal_failures_total", "Number of proposals failed or rejected by peer and not retried.", "peer", "conn")
+	proposalRetries   = basic.NewCounterVec("stupid_proposal_retries_total", "Number of failed proposals retried on another peer.", "peer", "conn")
+	proposalRouted    = basic.NewCounterVec("stupid_proposal_routed_total", "Number of proposals routed to the connection by the dispatcher.", "peer", "conn")
+	proposalDuration  = basic.NewHistogramVec("stupid_proposal_duration_seconds", "Time taken by peer to endorse a proposal.", basic.LatencyBuckets, "peer", "conn")
+
+	broadcastTotal      = basic.NewCounterVec("stupid_broadcasts_total", "Number of envelopes sent to orderer.", "orderer", "conn")
+	broadcastSuccesses  = basic.NewCounterVec("stupid_broadcast_successes_total", "Number of envelopes accepted by orderer.", "orderer", "conn")
+	broadcastFailures   = basic.NewCounterVec("stupid_broadcast_failures_total", "Number of envelopes failed or rejected by orderer and not retried.", "orderer", "conn")
+	broadcastRetries    = basic.NewCounterVec("stupid_broadcast_retries_total", "Number of failed or rejected envelopes retried.", "orderer", "conn")
+	broadcastRouted     = basic.NewCounterVec("stupid_broadcast_routed_total", "Number of envelopes routed to the connection by the dispatcher.", "orderer", "conn")
+	broadcastDuration   = basic.NewHistogramVec("stupid_broadcast_duration_seconds", "Time between sending an envelope and receiving its ack.", basic.LatencyBuckets, "orderer", "conn")
+	broadcastReconnects = basic.NewCounterVec("stupid_broadcast_reconnects_total", "Number of times a broken broadcast stream was recreated.", "orderer", "conn")
+	broadcastResent     = basic.NewCounterVec("stupid_broadcast_resent_total", "Number of in-flight envelopes resent after reconnecting.", "orderer", "conn")
+	broadcastLost       = basic.NewCounterVec("stupid_broadcast_lost_total", "Number of in-flight envelopes reported lost after a broken stream.", "orderer", "conn")
+
+	commitTotal    = basic.NewCounterVec("stupid_commits_total", "Number of transactions observed in committed blocks.", "peer")
+	commitDuration = basic.NewHistogramVec("stupid_commit_duration_seconds", "Time from proposal creation to transaction commit.", basic.LatencyBuckets, "peer")
+	commitIntended = basic.NewHistogramVec("stupid_commit_intended_duration_seconds", "Time from intended send time in the rate schedule to transaction commit.", basic.LatencyBuckets, "peer")
+
+	operationDuration = basic.NewHistogramVec("stupid_operation_duration_seconds", "Time from the first proposal of an operation to its valid commit, including resubmissions.", basic.LatencyBuckets, "peer")
+)
+
+// endpointStat 一个gRPC连接上的统计，同时导出为Prometheus指标
+type endpointStat struct {
+	stage    string
+	addr     string
+	conn     int
+	total    *basic.Counter
+	success  *basic.Counter
+	failures *basic.Counter // 最终失败，不包括会重试的
+	retried  *basic.Counter
+	routed   *basic.Counter // Dispatcher分给这个连接的交易数，不包括重试
+	duration *basic.Histogram
+	latency  uint64 // atomic，时延的EWMA，float64的位
+
+	// 只有broadcast有，其它为nil
+	reconnects *basic.Counter
+	resent     *basic.Counter
+	lost       *basic.Counter
+}
+
+var (
+	endpointLock sync.Mutex
+	endpoints    []*endpointStat
+)
+
+func newProposalStat(addr string, conn int) *endpointStat {
+	return newEndpointStat("proposal", addr, conn, proposalTotal, proposalSuccesses, proposalFailures, proposalRetries, proposalRouted, proposalDuration)
+}
+
+func newBroadcastStat(addr string, conn int) *endpointStat {
+	e := newEndpointStat("broadcast", addr, conn, broadcastTotal, broadcastSuccesses, broadcastFailures, broadcastRetries, broadcastRouted, broadcastDuration)
+	c := fmt.Sprintf("%d", conn)
+	e.reconnects = broadcastReconnects.With(addr, c)
+	e.resent = broadcastResent.With(addr, c)
+	e.lost = broadcastLost.With(addr, c)
+	return e
+}
+
+func newEndpointStat(stage, addr string, conn int, total, success, failures, retried, routed *basic.CounterVec, duration *basic.HistogramVec) *endpointStat {
+	c := fmt.Sprintf("%d", conn)
+	e := &endpointStat{
+		stage:    stage,
+		addr:     addr,
+		conn:     conn,
+		total:    total.With(addr, c),
+		success:  success.With(addr, c),
+		failures: failures.With(addr, c),
+		retried:  retried.With(addr, c),
+		routed:   routed.With(addr, c),
+		duration: duration.With(addr, c),
+	}
+
+	endpointLock.Lock()
+	defer endpointLock.Unlock()
+	endpoints = append(endpoints, e)
+	return e
+}
+
+const ewmaWeight = 0.2 // 新的时延在EWMA中的权重
+
+// observe 记录一次时延，同时更新EWMA
+func (e *endpointStat) observe(seconds float64) {
+	e.duration.Observe(seconds)
+	for {
+		old := atomic.LoadUint64(&e.latency)
+		v := seconds
+		if old != 0 {
+			v = ewmaWeight*seconds + (1-ewmaWeight)*math.Float64frombits(old)
+		}
+		if atomic.CompareAndSwapUint64(&e.latency, old, math.Float64bits(v)) {
+			return
+		}
+	}
+}
+
+// getLatency 时延的EWMA，秒，还没有时延时为0
+func (e *endpointStat) getLatency() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&e.latency))
+}
+
+func (e *endpointStat) report() basic.EndpointReport {
+	r := basic.EndpointReport{
+		Stage:    e.stage,
+		Endpoint: e.addr,
+		Conn:     e.conn,
+		Total:    e.total.Get(),
+		Success:  e.success.Get(),
+		Fail:     e.failures.Get(),
+		Retried:  e.retried.Get(),
+		Routed:   e.routed.Get(),
+		Latency:  basic.NewLatencyReport(e.stage, e.duration),
+	}
+	if e.reconnects != nil {
+		r.Reconnects, r.Resent, r.Lost = e.reconnects.Get(), e.resent.Get(), e.lost.Get()
+	}
+	return r
+}
+
+// GetConnectionStats 返回每个gRPC连接的统计
+func GetConnectionStats() []basic.EndpointReport {
+	endpointLock.Lock()
+	defer endpointLock.Unlock()
+
+	var reports []basic.EndpointReport
+	for _, e := range endpoints {
+		reports = append(reports, e.report())
+	}
+	return reports
+}
+
+// GetEndpointStats 返回每个节点所有连接汇总后的统计，Conn为-1
+func GetEndpointStats() []basic.EndpointReport {
+	endpointLock.Lock()
+	defer endpointLock.Unlock()
+
+	var reports []basic.EndpointReport
+	index := make(map[string]int)
+	for _, e := range endpoints {
+		key := e.stage + "@" + e.addr
+		i, ok := index[key]
+		if !ok {
+			i = len(reports)
+			index[key] = i
+			reports = append(reports, basic.EndpointReport{Stage: e.stage, Endpoint: e.addr, Conn: -1})
+		}
+		r := e.report()
+		reports[i].Total += r.Total
+		reports[i].Success += r.Success
+		reports[i].Fail += r.Fail
+		reports[i].Retried += r.Retried
+		reports[i].Routed += r.Routed
+		reports[i].Reconnects += r.Reconnects
+		reports[i].Resent += r.Resent
+		reports[i].Lost += r.Lost
+	}
+	hists := endpointHistograms()
+	for i := range reports {
+		reports[i].Latency = basic.NewLatencyReport(reports[i].Stage, hists[reports[i].Stage+"@"+reports[i].Endpoint])
+	}
+	return reports
+}
+
+// endpointHistograms 每个节点所有连接合并后的时延，key为stage@addr，调用时持有endpointLock
+func endpointHistograms() map[string]*basic.Histogram {
+	hists := make(map[string]*basic.Histogram)
+	for _, e := range endpoints {
+		key := e.stage + "@" + e.addr
+		if hists[key] == nil {
+			hists[key] = basic.NewHistogram(basic.LatencyBuckets)
+		}
+		hists[key].Merge(e.duration)
+	}
+	return hists
+}
+
+// GetHistograms 返回各阶段以及各节点(stage@addr)的时延直方图，用于合并多个进程的报告
+func GetHistograms() map[string]*basic.Histogram {
+	endpointLock.Lock()
+	hists := endpointHistograms()
+	endpointLock.Unlock()
+
+	hists["proposal"] = proposalDuration.Merged()
+	hists["broadcast"] = broadcastDuration.Merged()
+	hists["commit"] = commitDuration.Merged()
+	hists["commit_intended"] = commitIntended.Merged()
+	hists["operation"] = operationDuration.Merged()
+	return hists
+}
+
+// GetCommitHistogram 返回所有节点合并后的上链时延
+func GetCommitHistogram() *basic.Histogram {
+	return commitDuration.Merged()
+}
+
+// GetLatency 返回各阶段所有节点合并后的时延统计
+func GetLatency() []basic.LatencyReport {
+	return []basic.LatencyReport{
+		basic.NewLatencyReport("proposal", proposalDuration.Merged()),
+		basic.NewLatencyReport("broadcast", broadcastDuration.Merged()),
+		basic.NewLatencyReport("commit", commitDuration.Merged()),
+		basic.NewLatencyReport("commit_intended", commitIntended.Merged()),
+	}
+}
@@ -1,9 +1,12 @@
 package infra
 
 import (
+	"context"
 	"fmt"
 	"github.com/hcg1314/stupid/assembler/basic"
+	"github.com/pkg/errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hyperledger/fabric/protos/peer"
@@ -11,45 +14,90 @@ import (
 
 var GlobalObserver *Observer
 
+// tracked 只保留计算时延需要的时间，不持有交易本身
+type tracked struct {
+	start     time.Time
+	intended  time.Time
+	broadcast time.Time
+	trace     *basic.Trace
+	op        Operation
+}
+
 type Observer struct {
-	d peer.Deliver_DeliverFilteredClient
+	d    peer.Deliver_DeliverFilteredClient
+	addr string
+
+	got     uint64       // atomic
+	failed  uint64       // atomic
+	quiet   int32        // atomic，非0时不打印区块信息
+	lock    sync.RWMutex // 保护pending和codes
+	signal  chan error
+	pending map[string]tracked // 已广播、等待上链的交易
+	codes   map[string]uint64  // 各验证码的交易数
+
+	commits  *basic.Counter
+	duration *basic.Histogram
+	intended *basic.Histogram
 
-	got    uint64
-	failed uint64
-	lock sync.RWMutex
-	signal chan error
+	// 验证失效后重做，由SetResubmit设置，没有设置时不重做
+	resubmitCodes map[string]bool
+	maxAttempts   int
+	resubmit      func(op Operation) bool
+	attempts      map[int]uint64 // 成功的操作按提交次数的分布，由lock保护
+	gaveUp        uint64         // 由lock保护
+	operation     *basic.Histogram
 }
 
-func CreateObserver(node basic.Node, channel string, crypto *basic.Crypto) *Observer {
-	deliverer, err := CreateDeliverFilteredClient(node, crypto.TLSCACerts)
+// CreateObserver 订阅区块，timeout内没有收到第一个应答时失败；ctx取消后Start退出
+func CreateObserver(ctx context.Context, node basic.Node, channel string, crypto *basic.Crypto, timeout time.Duration) (*Observer, error) {
+	// 超时只作用于建立订阅，之后stream随ctx一直存在
+	ctx, cancel := context.WithCancel(ctx)
+	deadline := time.AfterFunc(timeout, cancel)
+	deliverer, err := CreateDeliverFilteredClient(ctx, node, crypto.TLSCACerts)
 	if err != nil {
-		panic(err)
+		cancel()
+		return nil, basic.WrapError(basic.ErrConnection, err, "connect to peer %s", node.Addr)
 	}
 
 	seek, err := CreateSignedDeliverNewestEnv(channel, crypto)
 	if err != nil {
-		panic(err)
+		cancel()
+		return nil, basic.WrapError(basic.ErrCrypto, err, "create seek envelope")
 	}
 
 	if err = deliverer.Send(seek); err != nil {
-		panic(err)
+		cancel()
+		return nil, basic.WrapError(basic.ErrConnection, err, "subscribe to blocks from %s", node.Addr)
 	}
 
 	// drain first response
 	if _, err = deliverer.Recv(); err != nil {
-		panic(err)
+		cancel()
+		return nil, basic.WrapError(basic.ErrConnection, err, "subscribe to blocks from %s", node.Addr)
 	}
+	deadline.Stop()
 
-	GlobalObserver = &Observer{
-		d:      deliverer,
-		got:    0,
-		failed: 0,
-		signal: make(chan error, 10),
-	}
+	GlobalObserver = newObserver(deliverer, node.Addr)
 
 	go GlobalObserver.Start()
 
-	return GlobalObserver
+	return GlobalObserver, nil
+}
+
+func newObserver(d peer.Deliver_DeliverFilteredClient, addr string) *Observer {
+	return &Observer{
+		d:        d,
+		addr:     addr,
+		got:      0,
+		failed:   0,
+		signal:   make(chan error, 10),
+		pending:  make(map[string]tracked),
+		codes:    make(map[string]uint64),
+		commits:  commitTotal.With(addr),
+		duration: commitDuration.With(addr),
+		intended: commitIntended.With(addr),
+		attempts: make(map[int]uint64),
+	}
 }
 
 func (o *Observer) Start() {
@@ -57,28 +105,178 @@ func (o *Observer) Start() {
 
 	now := time.Now()
 
-	for  {
+	for {
 		r, err := o.d.Recv()
 		if err != nil {
+			// ctx取消时也在这里退出
 			o.signal <- err
+			return
 		}
 
-		fb := r.Type.(*peer.DeliverResponse_FilteredBlock)
-		o.got += uint64(len(fb.FilteredBlock.FilteredTransactions))
+		var fb *peer.DeliverResponse_FilteredBlock
+		switch t := r.Type.(type) {
+		case *peer.DeliverResponse_FilteredBlock:
+			fb = t
+		case *peer.DeliverResponse_Status:
+			// 没有权限、通道不存在或者peer不可用，peer随后会关闭stream
+			err = &basic.Error{Kind: basic.ErrConnection, Err: errors.Errorf("deliver from %s ended with status %s", o.addr, t.Status)}
+			basic.RecordError("commit", o.addr, err)
+			o.signal <- err
+			return
+		default:
+			continue
+		}
+		// 只统计自己发出的交易，多个进程一起压测时区块中还有别人的交易
+		own, ops := o.observe(fb.FilteredBlock.FilteredTransactions)
+		// 先交给重做的交易计入生成数，再计入上链数，避免未确认数短暂降为0
+		for _, op := range ops {
+			if !o.resubmit(op) {
+				o.GiveUp()
+			}
+		}
+		got := atomic.AddUint64(&o.got, own)
+		o.commits.Add(own)
 		duration := time.Since(now)
+		if atomic.LoadInt32(&o.quiet) != 0 {
+			continue
+		}
 		fmt.Printf("Time %v\tBlock %d\tTx %d\tTotal %d\ttps: %f\n",
 			duration, fb.FilteredBlock.Number, len(fb.FilteredBlock.FilteredTransactions),
-			o.got, float64(o.got)/duration.Seconds(),
+			got, float64(got)/duration.Seconds(),
 		)
 	}
 }
 
-func (o *Observer) AddFailed() {
+// observe 返回其中由本进程发出的交易数，以及需要重做的操作
+func (o *Observer) observe(txs []*peer.FilteredTransaction) (uint64, []Operation) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	var own uint64
+	var ops []Operation
+	for _, tx := range txs {
+		t, ok := o.pending[tx.Txid]
+		if !ok {
+			continue
+		}
+		own++
+		o.codes[tx.TxValidationCode.String()] += 1
+		delete(o.pending, tx.Txid)
+		now := time.Now()
+		o.duration.Observe(now.Sub(t.start).Seconds())
+		o.intended.Observe(now.Sub(t.intended).Seconds())
+
+		if o.resubmit != nil {
+			switch {
+			case tx.TxValidationCode == peer.TxValidationCode_VALID:
+				o.attempts[t.op.Attempt]++
+				o.operation.Observe(now.Sub(t.op.First).Seconds())
+			case !o.resubmitCodes[tx.TxValidationCode.String()]:
+			case t.op.Attempt < o.maxAttempts:
+				ops = append(ops, t.op)
+			default:
+				o.gaveUp++
+			}
+		}
+
+		if t.trace != nil {
+			code := tx.TxValidationCode.String()
+			var err error
+			if tx.TxValidationCode != peer.TxValidationCode_VALID {
+				err = errors.New(code)
+			}
+			t.trace.Span("commit", o.addr, 1, t.broadcast, now, code, err)
+			t.trace.Finish(code, err)
+		}
+	}
+	return own, ops
+}
+
+// Track 登记一个即将广播的交易，上链时据此计算端到端时延
+func (o *Observer) Track(e *Elements) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.pending[e.TxID] = tracked{start: e.Start, intended: e.Intended, broadcast: time.Now(), trace: e.Trace, op: e.Op}
+}
+
+func (o *Observer) Untrack(txid string) {
 	o.lock.Lock()
 	defer o.lock.Unlock()
-	o.failed += 1
+	delete(o.pending, txid)
+}
+
+// GetValidationCodes 返回已观察到的交易按验证码的分布
+func (o *Observer) GetValidationCodes() map[string]uint64 {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	codes := make(map[string]uint64, len(o.codes))
+	for k, v := range o.codes {
+		codes[k] = v
+	}
+	return codes
+}
+
+// SetResubmit 自己的交易因为codes中的验证码失效、提交次数还不到maxAttempts时，
+// 把操作交给f重做，f不接受时计为放弃。f在接收区块的goroutine中调用，不能阻塞，必须在发出交易之前设置
+func (o *Observer) SetResubmit(codes []string, maxAttempts int, f func(op Operation) bool) error {
+	set := make(map[string]bool, len(codes))
+	for _, c := range codes {
+		if _, ok := peer.TxValidationCode_value[c]; !ok || c == peer.TxValidationCode_VALID.String() {
+			return errors.Errorf("unknown or valid validation code %s", c)
+		}
+		set[c] = true
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.resubmitCodes = set
+	o.maxAttempts = maxAttempts
+	o.resubmit = f
+	o.operation = operationDuration.With(o.addr)
+	return nil
+}
+
+// GiveUp 需要重做的操作没有重做，计为放弃
+func (o *Observer) GiveUp() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.gaveUp++
+}
+
+// GetResubmitReport 返回重做的统计，不包括重做的交易数，没有设置重做时返回nil
+func (o *Observer) GetResubmitReport() *basic.ResubmitReport {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+	if o.resubmit == nil {
+		return nil
+	}
+	r := &basic.ResubmitReport{
+		MaxAttempts: o.maxAttempts,
+		Attempts:    make(map[int]uint64, len(o.attempts)),
+		GaveUp:      o.gaveUp,
+		Latency:     basic.NewLatencyReport("operation", o.operation),
+	}
+	for k, v := range o.attempts {
+		r.Attempts[k] = v
+	}
+	return r
+}
+
+// SetQuiet 关闭或打开每个区块的打印
+func (o *Observer) SetQuiet(quiet bool) {
+	var q int32
+	if quiet {
+		q = 1
+	}
+	atomic.StoreInt32(&o.quiet, q)
+}
+
+func (o *Observer) AddFailed() {
+	atomic.AddUint64(&o.failed, 1)
+}
+
+func (o *Observer) GetTxNumOfCommitted() uint64 {
+	return atomic.LoadUint64(&o.got)
 }
 
 func (o *Observer) GetTxNumOfObserved() uint64 {
-	return o.got + o.failed
+	return atomic.LoadUint64(&o.got) + atomic.LoadUint64(&o.failed)
 }
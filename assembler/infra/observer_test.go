@@ -0,0 +1,142 @@
+package infra
+
+import (
+	"github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/peer"
+	"google.golang.org/grpc"
+	"io"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDeliver 把blocks中的区块交给Observer，blocks关闭后订阅结束
+type fakeDeliver struct {
+	grpc.ClientStream // Observer不用的方法
+	blocks            chan *peer.DeliverResponse
+}
+
+func (d *fakeDeliver) Send(*common.Envelope) error {
+	return nil
+}
+
+func (d *fakeDeliver) Recv() (*peer.DeliverResponse, error) {
+	r, ok := <-d.blocks
+	if !ok {
+		return nil, io.EOF
+	}
+	return r, nil
+}
+
+func filteredBlock(number uint64, txs map[string]peer.TxValidationCode) *peer.DeliverResponse {
+	fb := &peer.FilteredBlock{Number: number}
+	for txid, code := range txs {
+		fb.FilteredTransactions = append(fb.FilteredTransactions, &peer.FilteredTransaction{Txid: txid, TxValidationCode: code})
+	}
+	return &peer.DeliverResponse{Type: &peer.DeliverResponse_FilteredBlock{FilteredBlock: fb}}
+}
+
+// 验证失效的操作交给重做，按成功时的提交次数统计，达到次数上限或者不再接受重做时计为放弃
+func TestObserverResubmit(t *testing.T) {
+	d := &fakeDeliver{blocks: make(chan *peer.DeliverResponse)}
+	o := newObserver(d, "peer-resubmit:7051")
+	o.SetQuiet(true)
+
+	var stopped int32
+	resubmits := make(chan Operation, 100)
+	// 和Assembler相同，Stop之后不再接受
+	err := o.SetResubmit([]string{"MVCC_READ_CONFLICT"}, 3, func(op Operation) bool {
+		if atomic.LoadInt32(&stopped) != 0 {
+			return false
+		}
+		resubmits <- op
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 时延直方图按节点全局登记，-count多次运行时累加
+	latencies := o.GetResubmitReport().Latency.Count
+	go o.Start()
+
+	first := time.Now()
+	track := func(txid, key string, attempt int) {
+		o.Track(&Elements{TxID: txid, Start: time.Now(), Intended: time.Now(), Op: Operation{Key: key, Attempt: attempt, First: first}})
+	}
+	var number uint64
+	// deliver 交给Observer一个区块，等它处理完
+	deliver := func(txs map[string]peer.TxValidationCode, committed uint64) []Operation {
+		number++
+		d.blocks <- filteredBlock(number, txs)
+		deadline := time.Now().Add(5 * time.Second)
+		for o.GetTxNumOfCommitted() != committed {
+			if time.Now().After(deadline) {
+				t.Fatalf("block %d: expect %d tx committed, got %d", number, committed, o.GetTxNumOfCommitted())
+			}
+			time.Sleep(time.Millisecond)
+		}
+		var ops []Operation
+		for len(resubmits) > 0 {
+			ops = append(ops, <-resubmits)
+		}
+		return ops
+	}
+	// expectOps expect为操作的key到提交次数
+	expectOps := func(ops []Operation, expect map[string]int) {
+		got := make(map[string]int)
+		for _, op := range ops {
+			got[op.Key] = op.Attempt
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("block %d: expect resubmitted %v, got %v", number, expect, got)
+		}
+	}
+
+	track("a1", "a", 1)
+	track("b1", "b", 1)
+	track("c1", "c", 1)
+	track("d1", "d", 1)
+	ops := deliver(map[string]peer.TxValidationCode{
+		"a1":    peer.TxValidationCode_VALID,
+		"b1":    peer.TxValidationCode_MVCC_READ_CONFLICT,
+		"c1":    peer.TxValidationCode_MVCC_READ_CONFLICT,
+		"d1":    peer.TxValidationCode_ENDORSEMENT_POLICY_FAILURE, // 不在重做的验证码中
+		"other": peer.TxValidationCode_MVCC_READ_CONFLICT,         // 不是本进程发出的
+	}, 4)
+	expectOps(ops, map[string]int{"b": 1, "c": 1})
+
+	track("b2", "b", 2)
+	track("c2", "c", 2)
+	ops = deliver(map[string]peer.TxValidationCode{
+		"b2": peer.TxValidationCode_VALID,
+		"c2": peer.TxValidationCode_MVCC_READ_CONFLICT,
+	}, 6)
+	expectOps(ops, map[string]int{"c": 2})
+
+	// 第3次提交已经达到上限
+	track("c3", "c", 3)
+	ops = deliver(map[string]peer.TxValidationCode{"c3": peer.TxValidationCode_MVCC_READ_CONFLICT}, 7)
+	expectOps(ops, map[string]int{})
+
+	atomic.StoreInt32(&stopped, 1)
+	track("e1", "e", 1)
+	ops = deliver(map[string]peer.TxValidationCode{"e1": peer.TxValidationCode_MVCC_READ_CONFLICT}, 8)
+	expectOps(ops, map[string]int{})
+
+	close(d.blocks)
+	for range o.signal {
+	}
+
+	r := o.GetResubmitReport()
+	if r.MaxAttempts != 3 || r.GaveUp != 2 || !reflect.DeepEqual(r.Attempts, map[int]uint64{1: 1, 2: 1}) {
+		t.Errorf("unexpected resubmit report %+v", r)
+	}
+	if n := r.Latency.Count - latencies; n != 2 {
+		t.Errorf("expect operation latency of 2 succeeded operations, got %d", n)
+	}
+	codes := map[string]uint64{"VALID": 2, "MVCC_READ_CONFLICT": 5, "ENDORSEMENT_POLICY_FAILURE": 1}
+	if c := o.GetValidationCodes(); !reflect.DeepEqual(c, codes) {
+		t.Errorf("expect validation codes %v, got %v", codes, c)
+	}
+}
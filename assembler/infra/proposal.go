@@ -50,7 +50,7 @@ func getFileData() []byte {
 	return data
 }
 
-func CreateProposal(signer *basic.Crypto, channel, ccname string, args ...string) *peer.Proposal {
+func CreateProposal(signer *basic.Crypto, channel, ccname string, args ...string) (*peer.Proposal, string, error) {
 	var argsInByte [][]byte
 	for _, arg := range args {
 		argsInByte = append(argsInByte, []byte(arg))
@@ -66,18 +66,18 @@ func CreateProposal(signer *basic.Crypto, channel, ccname string, args ...string
 
 	creator, err := signer.Serialize()
 	if err != nil {
-		panic(err)
+		return nil, "", basic.WrapError(basic.ErrCrypto, err, "serialize identity")
 	}
 
 	transientMap := make(map[string][]byte)
 	transientMap["data"] = getFileData()
 
-	prop, _, err := utils.CreateChaincodeProposalWithTransient(common.HeaderType_ENDORSER_TRANSACTION, channel, invocation, creator, transientMap)
+	prop, txid, err := utils.CreateChaincodeProposalWithTransient(common.HeaderType_ENDORSER_TRANSACTION, channel, invocation, creator, transientMap)
 	if err != nil {
-		panic(err)
+		return nil, "", basic.WrapError(basic.ErrCrypto, err, "create proposal")
 	}
 
-	return prop
+	return prop, txid, nil
 }
 
 func SignProposal(prop *peer.Proposal, signer *basic.Crypto) (*peer.SignedProposal, error) {
@@ -88,7 +88,7 @@ func SignProposal(prop *peer.Proposal, signer *basic.Crypto) (*peer.SignedPropos
 
 	sig, err := signer.Sign(propBytes)
 	if err != nil {
-		return nil, err
+		return nil, basic.WrapError(basic.ErrCrypto, err, "sign proposal")
 	}
 
 	return &peer.SignedProposal{ProposalBytes: propBytes, Signature: sig}, nil
@@ -96,7 +96,7 @@ func SignProposal(prop *peer.Proposal, signer *basic.Crypto) (*peer.SignedPropos
 
 func CreateSignedTx(proposal *peer.Proposal, signer *basic.Crypto, resps ...*peer.ProposalResponse) (*common.Envelope, error) {
 	if len(resps) == 0 {
-		return nil, errors.New("at least one proposal response is required")
+		return nil, &basic.Error{Kind: basic.ErrEndorsement, Err: errors.New("at least one proposal response is required")}
 	}
 
 	// the original header
@@ -139,13 +139,13 @@ func CreateSignedTx(proposal *peer.Proposal, signer *basic.Crypto, resps ...*pee
 		if n == 0 {
 			a1 = r.Payload
 			if r.Response.Status < 200 || r.Response.Status >= 400 {
-				return nil, errors.Errorf("proposal response was not successful, error code %d, msg %s", r.Response.Status, r.Response.Message)
+				return nil, &basic.Error{Kind: basic.ErrEndorsement, Err: errors.Errorf("proposal response was not successful, error code %d, msg %s", r.Response.Status, r.Response.Message)}
 			}
 			continue
 		}
 
 		if bytes.Compare(a1, r.Payload) != 0 {
-			return nil, errors.New("ProposalResponsePayloads do not match")
+			return nil, &basic.Error{Kind: basic.ErrEndorsement, Err: errors.New("ProposalResponsePayloads do not match")}
 		}
 	}
 
@@ -193,7 +193,7 @@ func CreateSignedTx(proposal *peer.Proposal, signer *basic.Crypto, resps ...*pee
 	// sign the payload
 	sig, err := signer.Sign(paylBytes)
 	if err != nil {
-		return nil, err
+		return nil, basic.WrapError(basic.ErrCrypto, err, "sign transaction")
 	}
 
 	// here's the envelope
@@ -5,76 +5,186 @@ import (
 	"fmt"
 	"github.com/hcg1314/stupid/assembler/basic"
 	"github.com/hyperledger/fabric/protos/peer"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/metadata"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type proposer struct {
+	ctx       context.Context
 	e         peer.EndorserClient
 	clientNum int
+	timeout   time.Duration // 单个ProcessProposal的超时
+	retry     *basic.RetryPolicy
+	peers     []*proposer // 同一个Dispatcher中的所有proposer，重试时从中选择
+	next      uint32      // atomic，轮流选择重试的proposer
 	signed    chan *Elements
 	result    chan int
+
+	stat *endpointStat
 }
 
-func CreateProposer(node basic.Node, crypto *basic.Crypto, clientNum int) *proposer {
-	endorser, err := CreateEndorserClient(node, crypto.TLSCACerts)
+func CreateProposer(ctx context.Context, node basic.Node, crypto *basic.Crypto, clientNum, conn int, timeout time.Duration, retry *basic.RetryPolicy) (*proposer, error) {
+	endorser, err := CreateEndorserClient(ctx, node, crypto.TLSCACerts)
 	if err != nil {
-		panic(err)
+		return nil, basic.WrapError(basic.ErrConnection, err, "connect to peer %s", node.Addr)
 	}
 
 	p := &proposer{
+		ctx:       ctx,
 		e:         endorser,
 		clientNum: clientNum,
+		timeout:   timeout,
+		retry:     retry,
 		signed:    make(chan *Elements, 1000),
+		stat:      newProposalStat(node.Addr, conn),
 	}
-	return p
+	return p, nil
 }
 
 func (p *proposer) Handle(e *Elements) error {
-	p.signed <- e
-	return nil
+	select {
+	case p.signed <- e:
+		return nil
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+func (p *proposer) Close() {
+	close(p.signed)
 }
 
 func (p *proposer) GetWait() int {
 	return len(p.signed)
 }
 
-func (p *proposer) Start(processed chan *Elements) {
+func (p *proposer) GetCap() int {
+	return cap(p.signed)
+}
+
+func (p *proposer) endpoint() *endpointStat {
+	return p.stat
+}
+
+// Start 启动clientNum个goroutine，都退出后workers归零
+func (p *proposer) Start(processed chan *Elements, workers *sync.WaitGroup) {
+	workers.Add(p.clientNum)
 	for seq := 0; seq < p.clientNum; seq++ {
-		go p.startProposer(processed)
+		go func() {
+			defer workers.Done()
+			p.startProposer(processed)
+		}()
 	}
 }
 
 func (p *proposer) startProposer(processed chan *Elements) {
+	rec := basic.NewRecorder()
 	for {
 		select {
-		case s,ok := <-p.signed:
+		case s, ok := <-p.signed:
 			if !ok {
 				return
 			}
-			basic.AddTotal(basic.ItemProposal)
-			r, err := p.e.ProcessProposal(context.Background(), s.SignedProp)
-			// err不为空时，r会为nil，r.Response会导致panic
-			if err != nil {
-				basic.AddFail(basic.ItemProposal)
-				GlobalObserver.AddFailed()
-				fmt.Printf("Err processing proposal, err: %v\n", err)
+			if !p.process(s, rec) {
 				continue
 			}
-			if r == nil {
-				basic.AddFail(basic.ItemProposal)
-				GlobalObserver.AddFailed()
-				continue
-			}
-			// 消息投递到peer，背书异常，输出具体原因
-			if r.Response.Status < 200 || r.Response.Status >= 400 {
-				fmt.Printf("Err processing proposal: %v, status: %d\n", r.Response.Message, r.Response.Status)
-				basic.AddFail(basic.ItemProposal)
-				GlobalObserver.AddFailed()
-				continue
+			select {
+			case processed <- s:
+			case <-p.ctx.Done():
+				return
 			}
-			basic.AddSuccess(basic.ItemProposal)
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
 
+// process 背书一个交易，失败时按重试策略换一个节点重试，成功时填好s.Response
+func (p *proposer) process(s *Elements, rec *basic.Recorder) bool {
+	target := p
+	for attempt := 1; ; attempt++ {
+		r, retry, err := target.endorse(s, rec, attempt)
+		if err == nil {
 			s.Response = r
-			processed <- s
+			return true
+		}
+		if !retry {
+			s.Trace.Finish("", err)
+			rec.AddFail(basic.ItemProposal)
+			target.stat.failures.Inc()
+			GlobalObserver.AddFailed()
+			return false
 		}
+		rec.AddRetry(basic.ItemProposal)
+		target.stat.retried.Inc()
+		select {
+		case <-time.After(p.retry.Backoff):
+		case <-p.ctx.Done():
+			return false
+		}
+		target = p.alternative(target)
+	}
+}
+
+// endorse 向当前节点发送一次提案，记录总数、成功和时延。
+// 失败时返回错误，以及按重试策略是否应该重试
+func (p *proposer) endorse(s *Elements, rec *basic.Recorder, attempt int) (*peer.ProposalResponse, bool, error) {
+	rec.AddTotal(basic.ItemProposal)
+	p.stat.total.Inc()
+	ctx, cancel := context.WithTimeout(p.ctx, p.timeout)
+	defer cancel()
+	if tp := s.Trace.TraceParent("endorse", p.stat.addr, attempt); tp != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "traceparent", tp)
+	}
+	start := time.Now()
+	r, err := p.e.ProcessProposal(ctx, s.SignedProp)
+	end := time.Now()
+	p.stat.observe(end.Sub(start).Seconds())
+	// err不为空时，r会为nil，r.Response会导致panic
+	if err != nil {
+		s.Trace.Span("endorse", p.stat.addr, attempt, start, end, "", err)
+		basic.RecordError(p.stat.stage, p.stat.addr, err)
+		return nil, p.retry.RetryError(attempt, err), err
+	}
+	if r == nil {
+		err = errors.New("empty proposal response")
+		s.Trace.Span("endorse", p.stat.addr, attempt, start, end, "", err)
+		basic.RecordError(p.stat.stage, p.stat.addr, err)
+		return nil, false, err
 	}
-}
\ No newline at end of file
+	// 消息投递到peer，背书异常，输出具体原因
+	status := fmt.Sprintf("%d", r.Response.Status)
+	if r.Response.Status < 200 || r.Response.Status >= 400 {
+		err = errors.New(r.Response.Message)
+		s.Trace.Span("endorse", p.stat.addr, attempt, start, end, status, err)
+		basic.RecordStatus(p.stat.stage, p.stat.addr, r.Response.Status, r.Response.Message)
+		return nil, p.retry.RetryStatus(attempt, r.Response.Status, ""), err
+	}
+	s.Trace.Span("endorse", p.stat.addr, attempt, start, end, status, nil)
+	rec.AddSuccess(basic.ItemProposal)
+	p.stat.success.Inc()
+	return r, false, nil
+}
+
+// alternative 重试时优先换一个节点，只有一个节点时换一个连接
+func (p *proposer) alternative(failed *proposer) *proposer {
+	n := len(p.peers)
+	start := int(atomic.AddUint32(&p.next, 1))
+	var fallback *proposer
+	for i := 0; i < n; i++ {
+		c := p.peers[(start+i)%n]
+		if c.stat.addr != failed.stat.addr {
+			return c
+		}
+		if fallback == nil && c != failed {
+			fallback = c
+		}
+	}
+	if fallback != nil {
+		return fallback
+	}
+	return failed
+}
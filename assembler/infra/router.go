@@ -0,0 +1,166 @@
+package infra
+
+import (
+	"fmt"
+	"github.com/hcg1314/stupid/assembler/basic"
+	"hash/fnv"
+	"sort"
+)
+
+// Router 为每个交易选择一个handler，只在Dispatcher.Start中调用，不需要并发安全
+type Router interface {
+	Route(e *Elements, handlers []Handler) int
+}
+
+// NewRouter 按名字创建路由策略，weights是每个handler的权重，只有weighted和hash使用
+func NewRouter(name string, weights []int) (Router, error) {
+	switch name {
+	case "", basic.RouteRoundRobin:
+		return &roundRobin{}, nil
+	case basic.RouteLeastQueued:
+		return &leastQueued{}, nil
+	case basic.RouteLeastLatency:
+		return &leastLatency{}, nil
+	case basic.RouteWeighted:
+		return &weighted{weights: weights, current: make([]int, len(weights))}, nil
+	case basic.RouteHash:
+		return newHashRing(weights), nil
+	}
+	return nil, fmt.Errorf("unknown routing strategy %s", name)
+}
+
+// roundRobin 依次轮流
+type roundRobin struct {
+	next int
+}
+
+func (r *roundRobin) Route(_ *Elements, handlers []Handler) int {
+	i := r.next % len(handlers)
+	r.next = i + 1
+	return i
+}
+
+// leastQueued 选择队列最短的，相同时轮流，避免总是选第一个
+type leastQueued struct {
+	next int
+}
+
+func (r *leastQueued) Route(_ *Elements, handlers []Handler) int {
+	n := len(handlers)
+	best, least := -1, 0
+	for k := 0; k < n; k++ {
+		i := (r.next + k) % n
+		if w := handlers[i].GetWait(); best < 0 || w < least {
+			best, least = i, w
+		}
+	}
+	r.next = (best + 1) % n
+	return best
+}
+
+// leastLatency 选择预计等待最短的：时延的EWMA乘以排在前面的交易数加1。
+// 还没有时延的handler按其它handler的平均时延计算，既会被试到，也不会因为代价为0一直被选中
+type leastLatency struct {
+	next int
+}
+
+func (r *leastLatency) Route(_ *Elements, handlers []Handler) int {
+	n := len(handlers)
+	var sum float64
+	var known int
+	for _, h := range handlers {
+		if l := h.endpoint().getLatency(); l > 0 {
+			sum += l
+			known++
+		}
+	}
+	unknown := 0.0
+	if known > 0 {
+		unknown = sum / float64(known)
+	}
+
+	best, least := -1, 0.0
+	for k := 0; k < n; k++ {
+		i := (r.next + k) % n
+		h := handlers[i]
+		l := h.endpoint().getLatency()
+		if l == 0 {
+			l = unknown
+		}
+		cost := l * float64(h.GetWait()+1)
+		if best < 0 || cost < least {
+			best, least = i, cost
+		}
+	}
+	r.next = (best + 1) % n
+	return best
+}
+
+// weighted 平滑加权轮询，每个handler被选中的比例等于它的权重占比，并且尽量均匀地穿插
+type weighted struct {
+	weights []int
+	current []int
+}
+
+func (r *weighted) Route(_ *Elements, _ []Handler) int {
+	total, best := 0, 0
+	for i, w := range r.weights {
+		r.current[i] += w
+		total += w
+		if r.current[i] > r.current[best] {
+			best = i
+		}
+	}
+	r.current[best] -= total
+	return best
+}
+
+const hashReplicas = 100 // 每个权重在环上的虚拟节点数
+
+// hashRing 一致性哈希，同一个key(重做时不变)总是发往同一个handler，
+// handler的虚拟节点数和权重成正比
+type hashRing struct {
+	points []uint32
+	owners map[uint32]int
+	next   int
+}
+
+func newHashRing(weights []int) *hashRing {
+	r := &hashRing{owners: make(map[uint32]int)}
+	for i, w := range weights {
+		for v := 0; v < w*hashReplicas; v++ {
+			p := hashKey(fmt.Sprintf("%d#%d", i, v))
+			if _, ok := r.owners[p]; ok {
+				continue
+			}
+			r.owners[p] = i
+			r.points = append(r.points, p)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+func (r *hashRing) Route(e *Elements, handlers []Handler) int {
+	key := e.Op.Key
+	if key == "" {
+		key = e.TxID
+	}
+	if len(r.points) == 0 || key == "" {
+		i := r.next % len(handlers)
+		r.next = i + 1
+		return i
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+func hashKey(s string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -0,0 +1,120 @@
+package infra
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeHandler 只提供路由需要的队列长度和时延
+type fakeHandler struct {
+	wait int
+	stat endpointStat
+}
+
+func (h *fakeHandler) Handle(*Elements) error  { return nil }
+func (h *fakeHandler) GetWait() int            { return h.wait }
+func (h *fakeHandler) GetCap() int             { return 1000 }
+func (h *fakeHandler) Close()                  {}
+func (h *fakeHandler) endpoint() *endpointStat { return &h.stat }
+
+func (h *fakeHandler) setLatency(seconds float64) {
+	atomic.StoreUint64(&h.stat.latency, math.Float64bits(seconds))
+}
+
+func fakeHandlers(n int) ([]Handler, []*fakeHandler) {
+	handlers := make([]Handler, n)
+	fakes := make([]*fakeHandler, n)
+	for i := range handlers {
+		fakes[i] = &fakeHandler{}
+		handlers[i] = fakes[i]
+	}
+	return handlers, fakes
+}
+
+func route(t *testing.T, r Router, handlers []Handler, n int) []int {
+	picks := make([]int, n)
+	for i := range picks {
+		picks[i] = r.Route(&Elements{TxID: fmt.Sprintf("tx%d", i)}, handlers)
+	}
+	return picks
+}
+
+func TestWeightedProportion(t *testing.T) {
+	handlers, _ := fakeHandlers(3)
+	r, err := NewRouter("weighted", []int{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make([]int, 3)
+	for _, i := range route(t, r, handlers, 600) {
+		counts[i]++
+	}
+	for i, want := range []int{100, 200, 300} {
+		if counts[i] != want {
+			t.Errorf("handler %d: expect %d, got %d", i, want, counts[i])
+		}
+	}
+}
+
+// 同一个key不管重做几次都发往同一个handler
+func TestHashRingStable(t *testing.T) {
+	handlers, _ := fakeHandlers(4)
+	r, err := NewRouter("hash", []int{1, 1, 1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make([]int, 4)
+	for k := 0; k < 1000; k++ {
+		key := fmt.Sprintf("%d", k)
+		first := r.Route(&Elements{TxID: "a", Op: Operation{Key: key, Attempt: 1}}, handlers)
+		for attempt := 2; attempt <= 3; attempt++ {
+			if i := r.Route(&Elements{TxID: fmt.Sprintf("tx%d", attempt), Op: Operation{Key: key, Attempt: attempt}}, handlers); i != first {
+				t.Fatalf("key %s went to %d then %d", key, first, i)
+			}
+		}
+		counts[first]++
+	}
+	for i, c := range counts {
+		if c < 150 {
+			t.Errorf("handler %d got only %d of 1000 keys: %v", i, c, counts)
+		}
+	}
+}
+
+func TestLeastQueuedRotatesOnTies(t *testing.T) {
+	handlers, fakes := fakeHandlers(3)
+	r, _ := NewRouter("least_queued", nil)
+	if picks := fmt.Sprint(route(t, r, handlers, 6)); picks != "[0 1 2 0 1 2]" {
+		t.Errorf("expect rotation on ties, got %s", picks)
+	}
+	fakes[0].wait, fakes[2].wait = 5, 5
+	if picks := fmt.Sprint(route(t, r, handlers, 3)); picks != "[1 1 1]" {
+		t.Errorf("expect the shortest queue, got %s", picks)
+	}
+}
+
+func TestLeastLatency(t *testing.T) {
+	handlers, fakes := fakeHandlers(3)
+	r, _ := NewRouter("least_latency", nil)
+	// 都还没有时延时轮流
+	if picks := fmt.Sprint(route(t, r, handlers, 6)); picks != "[0 1 2 0 1 2]" {
+		t.Errorf("expect rotation without samples, got %s", picks)
+	}
+
+	// 没有时延的1按平均时延0.2计算，比0慢，不会一直被选中
+	fakes[0].setLatency(0.1)
+	fakes[2].setLatency(0.3)
+	for _, i := range route(t, r, handlers, 6) {
+		if i != 0 {
+			t.Fatalf("expect the fastest handler 0, got %d", i)
+		}
+	}
+
+	// 代价相同时轮流
+	fakes[0].wait = 1 // 0.1*2=0.2，和1相同
+	if picks := fmt.Sprint(route(t, r, handlers, 4)); picks != "[1 0 1 0]" && picks != "[0 1 0 1]" {
+		t.Errorf("expect rotation between equal costs, got %s", picks)
+	}
+}
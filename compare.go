@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hcg1314/stupid/assembler/basic"
+)
+
+// threshold 某个指标允许的最大退化，percent为true时按相对基线的百分比计算
+type threshold struct {
+	metric  string
+	limit   float64
+	percent bool
+}
+
+type thresholds []threshold
+
+func (t *thresholds) String() string {
+	var list []string
+	for _, th := range *t {
+		if th.percent {
+			list = append(list, fmt.Sprintf("%s=%g%%", th.metric, th.limit))
+		} else {
+			list = append(list, fmt.Sprintf("%s=%g", th.metric, th.limit))
+		}
+	}
+	return strings.Join(list, ",")
+}
+
+// Set 解析metric=10%或者metric=0.01，可以逗号分隔多个
+func (t *thresholds) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid threshold %q, expecting metric=limit", item)
+		}
+		th := threshold{metric: kv[0]}
+		limit := kv[1]
+		if strings.HasSuffix(limit, "%") {
+			th.percent = true
+			limit = strings.TrimSuffix(limit, "%")
+		}
+		v, err := strconv.ParseFloat(limit, 64)
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid threshold %q: limit must be a non-negative number", item)
+		}
+		th.limit = v
+		*t = append(*t, th)
+	}
+	return nil
+}
+
+// higherIsBetter 吞吐类指标越大越好，其它(时延、失败率)越小越好
+func higherIsBetter(metric string) bool {
+	return strings.HasSuffix(metric, "_tps")
+}
+
+// reportMetrics 把报告展开成可以比较的指标，时延单位毫秒
+func reportMetrics(r *basic.Report) map[string]float64 {
+	m := map[string]float64{
+		"offered_tps":  r.OfferedTPS,
+		"achieved_tps": r.AchievedTPS,
+	}
+	for _, s := range r.Stages {
+		rate := 0.0
+		if s.Total > 0 {
+			rate = float64(s.Fail) / float64(s.Total)
+		}
+		m[s.Stage+".failure_rate"] = rate
+	}
+	for _, l := range r.Latency {
+		m[l.Stage+".mean"] = l.Mean * 1e3
+		m[l.Stage+".p50"] = l.P50 * 1e3
+		m[l.Stage+".p90"] = l.P90 * 1e3
+		m[l.Stage+".p95"] = l.P95 * 1e3
+		m[l.Stage+".p99"] = l.P99 * 1e3
+		m[l.Stage+".p999"] = l.P999 * 1e3
+		m[l.Stage+".max"] = l.Max * 1e3
+	}
+	return m
+}
+
+// regression 返回run相对base的退化量，正数表示变差，percent时为百分比
+func regression(metric string, base, run float64, percent bool) float64 {
+	diff := run - base
+	if higherIsBetter(metric) {
+		diff = -diff
+	}
+	if !percent {
+		return diff
+	}
+	if base == 0 {
+		if diff > 0 {
+			return math.Inf(1)
+		}
+		return 0
+	}
+	return diff / math.Abs(base) * 100
+}
+
+func compareUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s compare [options] baseline.json run.json [run.json...]\n\n"+
+			"Compare saved summary reports against the first one, exit with 1 on regression.\n"+
+			"Metrics: offered_tps, achieved_tps, <stage>.failure_rate, <stage>.{mean,p50,p90,p95,p99,p999,max} (ms)\n\n",
+			os.Args[0])
+		fs.PrintDefaults()
+	}
+}
+
+// runCompare 实现compare子命令，返回进程退出码
+func runCompare(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+	var limits thresholds
+	fs.Var(&limits, "threshold", "max allowed regression, e.g. commit.p99=10% or proposal.failure_rate=0.01, can be repeated")
+	fs.Usage = compareUsage(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return 2
+	}
+
+	var names []string
+	var runs []map[string]float64
+	for _, path := range fs.Args() {
+		r, err := basic.LoadReport(path)
+		if err != nil {
+			fmt.Fprintf(out, "Failed to load report %s: %s\n", path, err)
+			return 2
+		}
+		names = append(names, path)
+		runs = append(runs, reportMetrics(r))
+	}
+
+	for _, th := range limits {
+		if _, ok := runs[0][th.metric]; !ok {
+			fmt.Fprintf(out, "Unknown metric %s in threshold\n", th.metric)
+			return 2
+		}
+	}
+
+	metrics := make([]string, 0, len(runs[0]))
+	for k := range runs[0] {
+		metrics = append(metrics, k)
+	}
+	sort.Strings(metrics)
+
+	fmt.Fprintf(out, "%-24s", "metric")
+	for _, n := range names {
+		fmt.Fprintf(out, "%26s", n)
+	}
+	fmt.Fprintln(out)
+	for _, metric := range metrics {
+		base := runs[0][metric]
+		fmt.Fprintf(out, "%-24s%26.3f", metric, base)
+		for _, run := range runs[1:] {
+			v, ok := run[metric]
+			if !ok {
+				fmt.Fprintf(out, "%16s(%8s)", "n/a", "missing")
+				continue
+			}
+			change := "n/a"
+			if base != 0 {
+				change = fmt.Sprintf("%+.1f%%", (v-base)/math.Abs(base)*100)
+			}
+			fmt.Fprintf(out, "%16.3f(%8s)", v, change)
+		}
+		fmt.Fprintln(out)
+	}
+
+	failed := false
+	for _, th := range limits {
+		for i, run := range runs[1:] {
+			// 比如这次运行没有某个阶段的时延，不能当作没有退化
+			v, ok := run[th.metric]
+			if !ok {
+				failed = true
+				fmt.Fprintf(out, "MISSING %s: %s is not in the report\n", names[i+1], th.metric)
+				continue
+			}
+			r := regression(th.metric, runs[0][th.metric], v, th.percent)
+			if r > th.limit {
+				failed = true
+				unit := ""
+				if th.percent {
+					unit = "%"
+				}
+				fmt.Fprintf(out, "REGRESSION %s: %s regressed by %.3f%s, limit %g%s\n",
+					names[i+1], th.metric, r, unit, th.limit, unit)
+			}
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hcg1314/stupid/assembler/basic"
+)
+
+func TestThresholdsSet(t *testing.T) {
+	var limits thresholds
+	if err := limits.Set("commit.p99=10%, achieved_tps=5%"); err != nil {
+		t.Fatal(err)
+	}
+	if err := limits.Set("proposal.failure_rate=0.01"); err != nil {
+		t.Fatal(err)
+	}
+	want := []threshold{
+		{metric: "commit.p99", limit: 10, percent: true},
+		{metric: "achieved_tps", limit: 5, percent: true},
+		{metric: "proposal.failure_rate", limit: 0.01},
+	}
+	if len(limits) != len(want) {
+		t.Fatalf("expect %d thresholds, got %v", len(want), limits)
+	}
+	for i := range want {
+		if limits[i] != want[i] {
+			t.Errorf("threshold %d: expect %+v, got %+v", i, want[i], limits[i])
+		}
+	}
+	if s := limits.String(); s != "commit.p99=10%,achieved_tps=5%,proposal.failure_rate=0.01" {
+		t.Errorf("unexpected String() %s", s)
+	}
+
+	for _, bad := range []string{"commit.p99", "commit.p99=", "commit.p99=-1", "commit.p99=ten%"} {
+		if err := (&thresholds{}).Set(bad); err == nil {
+			t.Errorf("expect error for %q", bad)
+		}
+	}
+}
+
+// 吞吐下降和时延上升都是正的退化
+func TestRegressionDirection(t *testing.T) {
+	cases := []struct {
+		metric    string
+		base, run float64
+		percent   bool
+		want      float64
+	}{
+		{"achieved_tps", 100, 90, true, 10},
+		{"achieved_tps", 100, 110, true, -10},
+		{"commit.p99", 100, 110, true, 10},
+		{"commit.p99", 100, 90, true, -10},
+		{"proposal.failure_rate", 0.01, 0.03, false, 0.02},
+		{"commit.p99", 0, 5, true, math.Inf(1)},
+	}
+	for _, c := range cases {
+		if got := regression(c.metric, c.base, c.run, c.percent); !closeTo(got, c.want) {
+			t.Errorf("regression(%s, %g, %g, %t) = %g, expect %g", c.metric, c.base, c.run, c.percent, got, c.want)
+		}
+	}
+}
+
+func closeTo(a, b float64) bool {
+	if a == b {
+		return true
+	}
+	d := a - b
+	return d < 1e-9 && d > -1e-9
+}
+
+func writeReport(t *testing.T, dir, name string, r *basic.Report) string {
+	raw, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(path, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// 基线中有而这次运行没有的指标，被阈值引用时要判为失败
+func TestCompareMissingMetric(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stupid-compare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := writeReport(t, dir, "base.json", &basic.Report{AchievedTPS: 100, Latency: []basic.LatencyReport{{Stage: "commit", P99: 0.1}}})
+	run := writeReport(t, dir, "run.json", &basic.Report{AchievedTPS: 100})
+
+	var out bytes.Buffer
+	if code := runCompare([]string{"-threshold", "commit.p99=10%", base, run}, &out); code != 1 {
+		t.Errorf("expect exit 1, got %d:\n%s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "MISSING") {
+		t.Errorf("missing metric not reported:\n%s", out.String())
+	}
+
+	out.Reset()
+	if code := runCompare([]string{"-threshold", "achieved_tps=5%", base, run}, &out); code != 0 {
+		t.Errorf("expect exit 0 when only present metrics are gated, got %d:\n%s", code, out.String())
+	}
+}
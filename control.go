@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hcg1314/stupid/assembler"
+	"github.com/hcg1314/stupid/assembler/basic"
+)
+
+// controlStatus GET /status的应答
+type controlStatus struct {
+	State     string  `json:"state"` // running, paused, stopping
+	Speed     uint    `json:"speed"`
+	Total     uint64  `json:"total"`
+	Generated uint64  `json:"generated"`
+	Committed uint64  `json:"committed"`
+	Elapsed   float64 `json:"elapsed_seconds"`
+}
+
+type controlStats struct {
+	Sample  *basic.Sample         `json:"sample"`
+	Latency []basic.LatencyReport `json:"latency"`
+}
+
+type controlRate struct {
+	Speed uint `json:"speed"`
+}
+
+// controlled 控制接口用到的Assembler方法，测试中替换为假的实现
+type controlled interface {
+	GetSpeed() uint
+	OverrideSpeed(speed uint) error
+	GetGenerated() uint64
+	GetCommitted() uint64
+	IsStopped() bool
+	IsPaused() bool
+	Pause()
+	Resume()
+	Stop()
+	Sample() *basic.Sample
+	GetLatency() []basic.LatencyReport
+	Report() *basic.Report
+}
+
+// controlServer 运行中的HTTP/JSON控制接口，供编排脚本使用
+type controlServer struct {
+	as    controlled
+	start time.Time
+
+	lock sync.Mutex
+	last *basic.Sample
+}
+
+func serveControl(addr string, as *assembler.Assembler) error {
+	c := &controlServer{as: as, start: time.Now()}
+	return http.ListenAndServe(addr, c.handler())
+}
+
+func (c *controlServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", c.get(c.status))
+	mux.HandleFunc("/stats", c.get(c.stats))
+	mux.HandleFunc("/rate", c.rate)
+	mux.HandleFunc("/pause", c.post(func() (interface{}, error) { c.as.Pause(); return c.status() }))
+	mux.HandleFunc("/resume", c.post(func() (interface{}, error) { c.as.Resume(); return c.status() }))
+	mux.HandleFunc("/stop", c.post(func() (interface{}, error) { c.as.Stop(); return c.status() }))
+	mux.HandleFunc("/snapshot", c.post(c.snapshot))
+	return mux
+}
+
+func (c *controlServer) get(f func() (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "GET only", http.StatusMethodNotAllowed)
+			return
+		}
+		c.reply(w, f)
+	}
+}
+
+func (c *controlServer) post(f func() (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		c.reply(w, f)
+	}
+}
+
+func (c *controlServer) reply(w http.ResponseWriter, f func() (interface{}, error)) {
+	v, err := f()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, v)
+}
+
+func (c *controlServer) status() (interface{}, error) {
+	s := &controlStatus{
+		State:     "running",
+		Speed:     c.as.GetSpeed(),
+		Total:     TotalTransaction,
+		Generated: c.as.GetGenerated(),
+		Committed: c.as.GetCommitted(),
+		Elapsed:   time.Since(c.start).Seconds(),
+	}
+	if c.as.IsStopped() {
+		s.State = "stopping"
+	} else if c.as.IsPaused() {
+		s.State = "paused"
+	}
+	return s, nil
+}
+
+// stats 增量和TPS相对于上一次调用/stats计算
+func (c *controlServer) stats() (interface{}, error) {
+	s := c.as.Sample()
+	c.lock.Lock()
+	s.Fill(c.last)
+	c.last = s
+	c.lock.Unlock()
+	return &controlStats{Sample: s, Latency: c.as.GetLatency()}, nil
+}
+
+// rate GET返回当前目标速度，POST修改
+func (c *controlServer) rate(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, &controlRate{Speed: c.as.GetSpeed()})
+	case http.MethodPost, http.MethodPut:
+		req := &controlRate{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid rate: %s", err), http.StatusBadRequest)
+			return
+		}
+		if err := c.as.OverrideSpeed(req.Speed); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		basic.Logf("target rate changed to %d", req.Speed)
+		writeJSON(w, req)
+	default:
+		http.Error(w, "GET or POST only", http.StatusMethodNotAllowed)
+	}
+}
+
+// snapshot 把到目前为止的汇总报告写到-report旁边，文件名带上时间
+func (c *controlServer) snapshot() (interface{}, error) {
+	r := c.as.Report()
+	ext := filepath.Ext(ReportPath)
+	path := strings.TrimSuffix(ReportPath, ext) + "-" + time.Now().Format("20060102-150405") + ext
+	if err := r.Save(path, strings.Split(ReportFormats, ",")); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hcg1314/stupid/assembler/basic"
+)
+
+// fakeAssembler 只记录控制接口的调用
+type fakeAssembler struct {
+	speed     uint
+	manual    bool
+	committed uint64
+	paused    bool
+	stopped   bool
+	samples   int
+}
+
+func (a *fakeAssembler) GetSpeed() uint { return a.speed }
+
+func (a *fakeAssembler) OverrideSpeed(speed uint) error {
+	if speed == 0 {
+		return errors.New("speed must be positive")
+	}
+	a.speed, a.manual = speed, true
+	return nil
+}
+
+func (a *fakeAssembler) GetGenerated() uint64 { return 100 }
+func (a *fakeAssembler) GetCommitted() uint64 { return a.committed }
+func (a *fakeAssembler) IsStopped() bool      { return a.stopped }
+func (a *fakeAssembler) IsPaused() bool       { return a.paused }
+func (a *fakeAssembler) Pause()               { a.paused = true }
+func (a *fakeAssembler) Resume()              { a.paused = false }
+func (a *fakeAssembler) Stop()                { a.stopped = true }
+
+func (a *fakeAssembler) Sample() *basic.Sample {
+	a.samples++
+	return &basic.Sample{Time: time.Now(), Committed: a.committed}
+}
+
+func (a *fakeAssembler) GetLatency() []basic.LatencyReport { return nil }
+func (a *fakeAssembler) Report() *basic.Report             { return &basic.Report{} }
+
+func request(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func TestControlMethods(t *testing.T) {
+	h := (&controlServer{as: &fakeAssembler{speed: 10}, start: time.Now()}).handler()
+	for _, c := range []struct{ method, path string }{
+		{http.MethodPost, "/status"},
+		{http.MethodPut, "/stats"},
+		{http.MethodGet, "/pause"},
+		{http.MethodGet, "/resume"},
+		{http.MethodGet, "/stop"},
+		{http.MethodGet, "/snapshot"},
+		{http.MethodDelete, "/rate"},
+	} {
+		if w := request(h, c.method, c.path, ""); w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: expect 405, got %d", c.method, c.path, w.Code)
+		}
+	}
+}
+
+func TestControlRate(t *testing.T) {
+	defer basic.SetLogOutput(basic.SetLogOutput(ioutil.Discard))
+	as := &fakeAssembler{speed: 10}
+	h := (&controlServer{as: as, start: time.Now()}).handler()
+
+	for _, body := range []string{"", "fast", `{"speed":-1}`, `{"speed":0}`} {
+		if w := request(h, http.MethodPost, "/rate", body); w.Code != http.StatusBadRequest {
+			t.Errorf("rate %q: expect 400, got %d", body, w.Code)
+		}
+	}
+	if as.speed != 10 || as.manual {
+		t.Fatalf("invalid rates changed the speed to %d", as.speed)
+	}
+
+	if w := request(h, http.MethodPost, "/rate", `{"speed":500}`); w.Code != http.StatusOK {
+		t.Fatalf("expect 200, got %d: %s", w.Code, w.Body)
+	}
+	if !as.manual {
+		t.Error("expect the speed overridden")
+	}
+	var rate controlRate
+	w := request(h, http.MethodGet, "/rate", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &rate); err != nil || rate.Speed != 500 {
+		t.Errorf("expect speed 500, got %s", w.Body)
+	}
+}
+
+func TestControlPauseResume(t *testing.T) {
+	as := &fakeAssembler{speed: 10, committed: 42}
+	h := (&controlServer{as: as, start: time.Now()}).handler()
+
+	for _, c := range []struct{ method, path, state string }{
+		{http.MethodGet, "/status", "running"},
+		{http.MethodPost, "/pause", "paused"},
+		{http.MethodGet, "/status", "paused"},
+		{http.MethodPost, "/resume", "running"},
+		{http.MethodPost, "/pause", "paused"},
+		{http.MethodPost, "/stop", "stopping"},
+	} {
+		w := request(h, c.method, c.path, "")
+		var s controlStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("%s %s: %d %s", c.method, c.path, w.Code, w.Body)
+		}
+		if s.State != c.state || s.Committed != 42 || s.Speed != 10 || s.Generated != 100 {
+			t.Errorf("%s %s: expect state %s, got %+v", c.method, c.path, c.state, s)
+		}
+	}
+	// /status只读计数，不构造完整的采样
+	if as.samples != 0 {
+		t.Errorf("status took %d samples", as.samples)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hcg1314/stupid/assembler/basic"
+)
+
+var (
+	coordinatorClient = &http.Client{Timeout: 30 * time.Second}
+	workerToken       string
+	workerScheme      = "http://"
+)
+
+// setupWorkerTLS 用ca验证worker的证书，之后没有写明协议的worker地址都使用https
+func setupWorkerTLS(ca string) error {
+	raw, err := ioutil.ReadFile(ca)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return fmt.Errorf("no certificate found in %s", ca)
+	}
+	coordinatorClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	workerScheme = "https://"
+	return nil
+}
+
+func workerURL(addr, path string) string {
+	if !strings.Contains(addr, "://") {
+		addr = workerScheme + addr
+	}
+	return strings.TrimSuffix(addr, "/") + path
+}
+
+// callWorker 发送请求，in不为nil时以JSON作为请求体，out不为nil时解析JSON应答
+func callWorker(method, addr, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, workerURL(addr, path), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+workerToken)
+	resp, err := coordinatorClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// splitJobs 按worker数平分速度、总数和key空间，余数分给前面的worker
+func splitJobs(config *basic.Config, files map[string][]byte, speed uint, total uint64, n int, startAt time.Time, drain time.Duration) []*workerJob {
+	jobs := make([]*workerJob, n)
+	var offset uint64
+	for i := range jobs {
+		job := &workerJob{
+			Config:  config,
+			Files:   files,
+			Speed:   speed / uint(n),
+			Total:   total,
+			StartAt: startAt,
+			Drain:   drain,
+		}
+		if uint(i) < speed%uint(n) {
+			job.Speed++
+		}
+		if total == math.MaxUint64 {
+			job.KeyOffset = uint64(i) * (math.MaxUint64 / uint64(n))
+		} else {
+			job.Total = total / uint64(n)
+			if uint64(i) < total%uint64(n) {
+				job.Total++
+			}
+			job.KeyOffset = offset
+			offset += job.Total
+		}
+		jobs[i] = job
+	}
+	return jobs
+}
+
+// readFiles 读出配置中引用的私钥和证书，分发给worker
+func readFiles(config *basic.Config) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for _, f := range append([]string{config.PrivateKey, config.SignCert}, config.TLSCACerts...) {
+		raw, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		files[f] = raw
+	}
+	return files, nil
+}
+
+// startWorkers 同时向所有worker下发任务，/run在worker连上Fabric之后才返回。
+// 有worker失败或者在startAt之后才就绪时返回错误和已经启动的worker，由调用者停止它们
+func startWorkers(workers []string, jobs []*workerJob, startAt time.Time) ([]string, error) {
+	errs := make([]error, len(workers))
+	ran := make([]bool, len(workers))
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if errs[i] = callWorker(http.MethodPost, workers[i], "/run", jobs[i], nil); errs[i] != nil {
+				return
+			}
+			ran[i] = true
+			if ready := time.Now(); ready.After(startAt) {
+				errs[i] = fmt.Errorf("ready %s after the start time, increase -start-delay", ready.Sub(startAt))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var started, problems []string
+	for i, err := range errs {
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("worker %s: %s", workers[i], err))
+		}
+		// 迟到的worker也已经在运行，同样需要停止
+		if ran[i] {
+			started = append(started, workers[i])
+		}
+	}
+	if len(problems) > 0 {
+		return started, fmt.Errorf("%d of %d workers not ready:\n  %s", len(problems), len(workers), strings.Join(problems, "\n  "))
+	}
+	return started, nil
+}
+
+// alive 去掉已经丢失的worker，保持原来的顺序
+func alive(workers []string, lost map[string]string) []string {
+	var res []string
+	for _, w := range workers {
+		if _, ok := lost[w]; !ok {
+			res = append(res, w)
+		}
+	}
+	return res
+}
+
+func stopWorkers(workers []string, out io.Writer) {
+	for _, w := range workers {
+		if err := callWorker(http.MethodPost, w, "/stop", nil, nil); err != nil {
+			fmt.Fprintf(out, "Failed to stop worker %s: %s\n", w, err)
+		}
+	}
+}
+
+// runCoordinator 实现coordinator子命令，返回进程退出码
+func runCoordinator(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("coordinator", flag.ContinueOnError)
+	workerList := fs.String("workers", "", "comma separated addresses of workers, e.g. 10.0.0.1:7070,10.0.0.2:7070")
+	path := fs.String("path", "", "the path of config file distributed to workers")
+	speed := fs.Uint("speed", 0, "the total num of transactions generated per second by all workers")
+	total := fs.Uint64("total", math.MaxUint64, "the total num of transactions generated by all workers")
+	reportPath := fs.String("report", "report.json", "the path of merged summary report")
+	reportFormats := fs.String("report-format", basic.FormatJSON, "comma separated formats of summary report: json, csv, md")
+	interval := fs.Duration("interval", time.Second, "the interval of polling workers for statistics")
+	drain := fs.Duration("drain-timeout", time.Minute, "how long workers wait for sent transactions to be committed after generation stops")
+	delay := fs.Duration("start-delay", 5*time.Second, "how long after distributing the job all workers start, clocks must be in sync")
+	deadline := fs.Duration("deadline", 0, "stop all workers this long after they start, 0 means no deadline")
+	pollFailures := fs.Int("poll-failures", 10, "give up a worker after this many polls in a row failed")
+	token := fs.String("token", os.Getenv(workerTokenEnv), "the shared token of workers, defaults to $"+workerTokenEnv)
+	workerCA := fs.String("worker-ca", "", "the CA certificate of workers serving TLS, plain HTTP if empty")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if strings.TrimSpace(*token) == "" {
+		fmt.Fprintf(out, "-token or $%s is required\n", workerTokenEnv)
+		fs.PrintDefaults()
+		return 2
+	}
+	workerToken = *token
+	if *workerCA != "" {
+		if err := setupWorkerTLS(*workerCA); err != nil {
+			fmt.Fprintf(out, "Failed to load worker CA: %s\n", err)
+			return 1
+		}
+	}
+	var workers []string
+	for _, w := range strings.Split(*workerList, ",") {
+		if w = strings.TrimSpace(w); w != "" {
+			workers = append(workers, w)
+		}
+	}
+	if len(workers) == 0 || *path == "" || *total < uint64(len(workers)) || *interval <= 0 || *speed < uint(len(workers)) || *pollFailures <= 0 || *deadline < 0 {
+		fmt.Fprintln(out, "-workers and -path are required, -speed and -total must be at least the number of workers, -poll-failures must be positive")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	config, err := basic.LoadConfig(*path)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	files, err := readFiles(config)
+	if err != nil {
+		fmt.Fprintf(out, "Failed to read crypto files: %s\n", err)
+		return 1
+	}
+
+	startAt := time.Now().Add(*delay)
+	jobs := splitJobs(config, files, *speed, *total, len(workers), startAt, *drain)
+	if started, err := startWorkers(workers, jobs, startAt); err != nil {
+		fmt.Fprintf(out, "Failed to start workers, %s\n", err)
+		stopWorkers(started, out)
+		return 1
+	}
+	for i, job := range jobs {
+		fmt.Fprintf(out, "worker %s: speed %d, total %d, key offset %d\n", workers[i], job.Speed, job.Total, job.KeyOffset)
+	}
+	fmt.Fprintf(out, "all workers start at %s\n", startAt.Format(time.RFC3339Nano))
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
+
+	// 停止之后worker还要等交易上链再交报告，过了giveUp仍未完成的worker当作丢失
+	var stopAt, giveUp time.Time
+	if *deadline > 0 {
+		stopAt = startAt.Add(*deadline)
+	}
+	lost := make(map[string]string)
+	failures := make(map[string]int)
+	stopped := false
+	stop := func(reason string) {
+		if stopped {
+			return
+		}
+		stopped = true
+		fmt.Fprintf(out, "%s, stopping workers\n", reason)
+		stopWorkers(alive(workers, lost), out)
+		giveUp = time.Now().Add(*drain + *interval*time.Duration(*pollFailures) + 30*time.Second)
+	}
+
+	t := time.NewTicker(*interval)
+	defer t.Stop()
+	var last uint64
+	lastTime := time.Now()
+	for {
+		select {
+		case sig := <-sigs:
+			stop(sig.String())
+			continue
+		case <-t.C:
+		}
+
+		done := 0
+		var committed uint64
+		for _, w := range alive(workers, lost) {
+			var status workerStatus
+			if err := callWorker(http.MethodGet, w, "/status", nil, &status); err != nil {
+				failures[w]++
+				fmt.Fprintf(out, "Failed to poll worker %s (%d/%d): %s\n", w, failures[w], *pollFailures, err)
+				if failures[w] >= *pollFailures {
+					lost[w] = fmt.Sprintf("%d polls in a row failed, last: %s", failures[w], err)
+					stop("worker " + w + " lost")
+				}
+				continue
+			}
+			failures[w] = 0
+			if status.State == workerDone {
+				done++
+			}
+			if status.Sample != nil {
+				committed += status.Sample.Committed
+			}
+		}
+		now := time.Now()
+		tps := 0.0
+		if committed > last {
+			tps = float64(committed-last) / now.Sub(lastTime).Seconds()
+		}
+		running := len(workers) - len(lost)
+		fmt.Fprintf(out, "Time %s\tCommitted %d\ttps: %.1f\tdone %d/%d\n", now.Format("15:04:05"), committed, tps, done, running)
+		last, lastTime = committed, now
+		if done == running {
+			break
+		}
+		if !stopAt.IsZero() && now.After(stopAt) {
+			stop(fmt.Sprintf("deadline %s passed", *deadline))
+		}
+		if stopped && now.After(giveUp) {
+			for _, w := range alive(workers, lost) {
+				lost[w] = "not done in time after being stopped"
+			}
+			break
+		}
+	}
+
+	var results []basic.WorkerResult
+	for _, w := range alive(workers, lost) {
+		res := basic.WorkerResult{}
+		if err := callWorker(http.MethodGet, w, "/report", nil, &res); err != nil {
+			lost[w] = fmt.Sprintf("failed to collect report: %s", err)
+			continue
+		}
+		res.Worker = w
+		results = append(results, res)
+	}
+	var missing []string
+	for _, w := range workers {
+		if reason, ok := lost[w]; ok {
+			fmt.Fprintf(out, "worker %s missing from the report: %s\n", w, reason)
+			missing = append(missing, w)
+		}
+	}
+	if len(results) == 0 {
+		fmt.Fprintln(out, "no worker report collected")
+		return 1
+	}
+	report, err := basic.MergeReports(config, results)
+	if err != nil {
+		fmt.Fprintf(out, "Failed to merge reports: %s\n", err)
+		return 1
+	}
+	report.Missing = missing
+	report.Speed, report.Total = *speed, *total
+	if err = report.Save(*reportPath, strings.Split(*reportFormats, ",")); err != nil {
+		fmt.Fprintf(out, "Failed to write report: %s\n", err)
+		return 1
+	}
+	fmt.Fprintf(out, "merged report of %d workers written, achieved %.2f tps\n", len(results), report.AchievedTPS)
+	if len(missing) > 0 {
+		fmt.Fprintf(out, "the report is partial, %d of %d workers missing\n", len(missing), len(workers))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/hcg1314/stupid/assembler/basic"
+)
+
+// 余数依次分给前面的worker，key空间首尾相接
+func TestSplitJobs(t *testing.T) {
+	jobs := splitJobs(&basic.Config{}, nil, 10, 11, 3, time.Time{}, time.Minute)
+	speeds := []uint{4, 3, 3}
+	totals := []uint64{4, 4, 3}
+	offsets := []uint64{0, 4, 8}
+	for i, job := range jobs {
+		if job.Speed != speeds[i] || job.Total != totals[i] || job.KeyOffset != offsets[i] {
+			t.Errorf("job %d: expect speed %d total %d offset %d, got %d %d %d",
+				i, speeds[i], totals[i], offsets[i], job.Speed, job.Total, job.KeyOffset)
+		}
+	}
+}
+
+// 不限总数时每个worker都不限，key空间平分避免重叠
+func TestSplitJobsUnlimited(t *testing.T) {
+	jobs := splitJobs(&basic.Config{}, nil, 4, math.MaxUint64, 2, time.Time{}, time.Minute)
+	for i, job := range jobs {
+		if job.Speed != 2 || job.Total != math.MaxUint64 {
+			t.Errorf("job %d: expect speed 2 and unlimited total, got %d %d", i, job.Speed, job.Total)
+		}
+	}
+	if jobs[0].KeyOffset != 0 || jobs[1].KeyOffset != math.MaxUint64/2 {
+		t.Errorf("key space not split: %d %d", jobs[0].KeyOffset, jobs[1].KeyOffset)
+	}
+}
+
+// 每个worker至少要分到一个交易，否则拆分后有worker的总数为0
+func TestCoordinatorRejectsSmallTotal(t *testing.T) {
+	var out bytes.Buffer
+	args := []string{"-workers", "a:7070,b:7070,c:7070", "-path", "config.json", "-speed", "3", "-total", "2", "-token", "secret"}
+	if code := runCoordinator(args, &out); code != 2 {
+		t.Errorf("expect exit 2 for -total below the number of workers, got %d:\n%s", code, out.String())
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hcg1314/stupid/assembler"
+	"github.com/hcg1314/stupid/assembler/basic"
+)
+
+const (
+	sparkWidth     = 60
+	dashErrorNum   = 5
+	dashMessageNum = 5 // 屏幕底部显示的最近几条提示
+)
+
+var sparkTicks = []rune("▁▂▃▄▅▆▇█")
+
+// restoreTerminal 显示光标并回到正常屏幕
+const restoreTerminal = "\x1b[?25h\x1b[?1049l"
+
+// dashboard 全屏终端界面，取代Observer的逐块打印和static.log
+type dashboard struct {
+	as      *assembler.Assembler
+	out     io.Writer
+	start   time.Time
+	last    *basic.Sample
+	history []float64
+	done    chan struct{}
+	exited  chan struct{}
+
+	// 运行中的提示由basic.Logf写到这里，显示在屏幕底部，退出时恢复原来的输出
+	lock     sync.Mutex
+	messages []string
+	prevLog  io.Writer
+}
+
+func startDashboard(as *assembler.Assembler, out io.Writer, interval time.Duration) *dashboard {
+	d := &dashboard{
+		as:     as,
+		out:    out,
+		start:  time.Now(),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+
+	as.SetQuiet(true)
+	basic.SetErrorSampleRate(0)
+	d.prevLog = basic.SetLogOutput(d)
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l") // 切换到备用屏幕并隐藏光标
+
+	go func() {
+		defer close(d.exited)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				d.render()
+			case <-d.done:
+				return
+			}
+		}
+	}()
+	return d
+}
+
+// Stop 恢复终端，之后的输出回到正常屏幕
+func (d *dashboard) Stop() {
+	close(d.done)
+	<-d.exited
+	basic.SetLogOutput(d.prevLog)
+	fmt.Fprint(d.out, restoreTerminal)
+}
+
+// Write 接收basic.Logf的输出，只保留最近的几行
+func (d *dashboard) Write(p []byte) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		d.messages = append(d.messages, time.Now().Format("15:04:05 ")+line)
+	}
+	if len(d.messages) > dashMessageNum {
+		d.messages = d.messages[len(d.messages)-dashMessageNum:]
+	}
+	return len(p), nil
+}
+
+func (d *dashboard) render() {
+	s := d.as.Sample()
+	s.Fill(d.last)
+	d.last = s
+
+	d.history = append(d.history, s.CommitTPS)
+	if len(d.history) > sparkWidth {
+		d.history = d.history[len(d.history)-sparkWidth:]
+	}
+
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	elapsed := time.Since(d.start)
+	fmt.Fprintf(&b, "stupid  elapsed %s  committed %d  ETA %s\n\n",
+		elapsed.Truncate(time.Second), s.Committed, d.eta(s.Committed, elapsed))
+
+	fmt.Fprintf(&b, "%-12s%12s%12s%12s%12s%12s%14s\n", "Stage", "Target/s", "Sent/s", "Success/s", "Fail/s", "Retry/s", "Total")
+	for _, st := range s.Stages {
+		fmt.Fprintf(&b, "%-12s%12d%12.1f%12.1f%12.1f%12.1f%14d\n",
+			st.Stage, s.TargetRate, d.rate(st.TotalDelta, s), d.rate(st.SuccessDelta, s), d.rate(st.FailDelta, s), d.rate(st.RetriedDelta, s), st.Total)
+	}
+	fmt.Fprintf(&b, "%-12s%12d%12s%12.1f%12s%12s%14d\n\n", "commit", s.TargetRate, "", s.CommitTPS, "", "", s.Committed)
+
+	fmt.Fprintf(&b, "Commit TPS  %s  %.1f\n\n", sparkline(d.history), s.CommitTPS)
+
+	b.WriteString("Queues      ")
+	for _, q := range []string{"raw", "proposer", "broadcaster"} {
+		fmt.Fprintf(&b, "%s %-8d", q, s.Queues[q])
+	}
+	fmt.Fprintf(&b, "schedule lag %.3fs\n", s.ScheduleLag)
+	if rt := s.Runtime; rt != nil {
+		fmt.Fprintf(&b, "Client      cpu %.1f%%  goroutines %d  heap %.1fMB  gc pause max %.1fms\n",
+			rt.CPU*100, rt.Goroutines, float64(rt.HeapBytes)/(1<<20), rt.GCPauseMax*1e3)
+		if len(rt.Saturated) > 0 {
+			fmt.Fprintf(&b, "\x1b[1;31mSATURATED   %s\x1b[0m\n", strings.Join(rt.Saturated, ", "))
+		}
+	}
+	b.WriteString("\n")
+
+	fmt.Fprintf(&b, "%-12s%10s%10s%10s%10s%10s%10s\n", "Latency(ms)", "Mean", "P50", "P90", "P99", "Max", "Count")
+	for _, l := range d.as.GetLatency() {
+		fmt.Fprintf(&b, "%-12s%10.1f%10.1f%10.1f%10.1f%10.1f%10d\n",
+			l.Stage, l.Mean*1e3, l.P50*1e3, l.P90*1e3, l.P99*1e3, l.Max*1e3, l.Count)
+	}
+	b.WriteString("\n")
+
+	b.WriteString(basic.GetErrorInfo(basic.TopErrors(dashErrorNum)))
+
+	d.lock.Lock()
+	if len(d.messages) > 0 {
+		b.WriteString("\nMessages\n")
+		for _, m := range d.messages {
+			b.WriteString(m + "\n")
+		}
+	}
+	d.lock.Unlock()
+	fmt.Fprint(d.out, b.String())
+}
+
+func (d *dashboard) rate(delta uint64, s *basic.Sample) float64 {
+	if s.Interval <= 0 {
+		return 0
+	}
+	return float64(delta) / s.Interval
+}
+
+// eta 按目前为止的平均提交速度估算达到-total还需要的时间
+func (d *dashboard) eta(committed uint64, elapsed time.Duration) string {
+	if TotalTransaction == math.MaxUint64 || committed == 0 {
+		return "-"
+	}
+	if committed >= TotalTransaction {
+		return "0s"
+	}
+	tps := float64(committed) / elapsed.Seconds()
+	left := time.Duration(float64(TotalTransaction-committed) / tps * float64(time.Second))
+	return left.Truncate(time.Second).String()
+}
+
+func sparkline(values []float64) string {
+	max := 0.0
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	var b strings.Builder
+	for _, v := range values {
+		i := 0
+		if max > 0 {
+			i = int(v / max * float64(len(sparkTicks)-1))
+		}
+		b.WriteRune(sparkTicks[i])
+	}
+	return b.String()
+}
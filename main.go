@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/hcg1314/stupid/assembler/basic"
@@ -8,6 +9,7 @@ import (
 	"math"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -18,6 +20,15 @@ var (
 	TotalTransaction uint64
 	Speed            uint
 	ConfigFilePath   string
+	MetricsAddr      string
+	ControlAddr      string
+	DrainTimeout     time.Duration
+	ReportPath       string
+	ReportFormats    string
+	StatInterval     time.Duration
+	StatFormat       string
+	ErrorSamples     int
+	Dashboard        bool
 	Help             bool
 )
 
@@ -25,6 +36,15 @@ func init() {
 	flag.Uint64Var(&TotalTransaction, "total", math.MaxUint64, "the num of transactions generated")
 	flag.UintVar(&Speed, "speed", 0, "the num of transactions generated per second")
 	flag.StringVar(&ConfigFilePath, "path", "", "the path of config file")
+	flag.StringVar(&MetricsAddr, "metrics", "", "the address to serve prometheus metrics on, e.g. :9100, disabled if empty")
+	flag.StringVar(&ControlAddr, "control", "", "the address to serve the HTTP control API on, e.g. 127.0.0.1:7071, disabled if empty")
+	flag.StringVar(&ReportPath, "report", "report.json", "the path of summary report written when the run finishes")
+	flag.StringVar(&ReportFormats, "report-format", basic.FormatJSON, "comma separated formats of summary report: json, csv, md")
+	flag.DurationVar(&StatInterval, "interval", time.Second, "the interval of statistics written to static.log")
+	flag.StringVar(&StatFormat, "stat-format", basic.FormatText, "the format of statistics written to static.log: text, csv, json")
+	flag.IntVar(&ErrorSamples, "error-samples", 10, "the max num of raw error messages printed per second")
+	flag.BoolVar(&Dashboard, "ui", false, "show a full-screen terminal dashboard instead of printing blocks and writing static.log")
+	flag.DurationVar(&DrainTimeout, "drain-timeout", time.Minute, "how long to wait for sent transactions to be committed after generation stops")
 	flag.BoolVar(&Help, "h", false, "help messages")
 }
 
@@ -36,51 +56,136 @@ func outputInfo(as *assembler.Assembler) {
 			f = os.Stdout
 		}
 	}
-	log1 := log.New(f, "", log.LstdFlags)
-	stat := time.NewTicker(time.Second)
+	stat := time.NewTicker(StatInterval)
+
+	if StatFormat != basic.FormatText {
+		ts, err := basic.NewTimeSeries(f, StatFormat)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for range stat.C {
+			if err = ts.Write(as.Sample()); err != nil {
+				fmt.Printf("Failed to write statistics: %s\n", err)
+			}
+		}
+	}
 
+	log1 := log.New(f, "", log.LstdFlags)
 	for {
 		select {
 		case <-stat.C:
-			info := basic.GetInfo() + fmt.Sprintf("Assembler: %s\n",as.GetInfo())
+			info := basic.GetInfo() + as.GetEndpointInfo() + as.GetErrorInfo() + as.GetRuntimeInfo() + fmt.Sprintf("Assembler: %s\n", as.GetInfo())
 			log1.Println(info)
 		}
 	}
 }
 
-func userCtrl(as *assembler.Assembler) {
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGUSR1)
+// userCtrl SIGUSR1、SIGINT和SIGTERM停止生成交易，已发出的交易继续处理直到-drain-timeout，
+// 再收到SIGINT或SIGTERM时立即退出，不写报告
+func userCtrl(stop func()) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGINT, syscall.SIGTERM)
 
 	sig := <-sigs
-	fmt.Println(sig)
-	as.Stop()
+	basic.Logf("%s, stop generating and drain sent transactions, send SIGINT again to quit immediately", sig)
+	stop()
+
+	for sig = range sigs {
+		if sig == syscall.SIGUSR1 {
+			continue
+		}
+		if Dashboard {
+			fmt.Print(restoreTerminal)
+		}
+		fmt.Printf("%s, quit without waiting\n", sig)
+		os.Exit(1)
+	}
+}
+
+func startPipeline(as *assembler.Assembler) {
+	as.StartPipeline(5, 5)
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "compare":
+			os.Exit(runCompare(os.Args[2:], os.Stdout))
+		case "worker":
+			os.Exit(runWorker(os.Args[2:], os.Stdout))
+		case "coordinator":
+			os.Exit(runCoordinator(os.Args[2:], os.Stdout))
+		case "preflight":
+			os.Exit(runPreflight(os.Args[2:], os.Stdout))
+		}
+	}
+
 	flag.Parse()
 	if Help {
 		flag.Usage()
 		return
 	}
-	if TotalTransaction == 0 || Speed == 0 {
+	if TotalTransaction == 0 || Speed == 0 || StatInterval <= 0 {
+		flag.Usage()
+		return
+	}
+	if StatFormat != basic.FormatText && StatFormat != basic.FormatCSV && StatFormat != basic.FormatJSON {
 		flag.Usage()
 		return
 	}
 
-	as := assembler.CreateAssembler(Speed, TotalTransaction, ConfigFilePath)
-	go userCtrl(as)
-
-	for i := 0; i < 5; i++ {
-		go as.StartSigner()     // sign proposal
-		go as.StartIntegrator() // create signed tx
+	basic.SetErrorSampleRate(ErrorSamples)
+	ctx, cancel := context.WithCancel(context.Background())
+	as, err := assembler.CreateAssembler(ctx, Speed, TotalTransaction, ConfigFilePath)
+	if err != nil {
+		fmt.Printf("Failed to start: %s\n", err)
+		cancel()
+		os.Exit(1)
 	}
+	go userCtrl(as.Stop)
 
+	startPipeline(as)
 	go as.Start()
 
-	go outputInfo(as)
+	var dash *dashboard
+	if Dashboard {
+		dash = startDashboard(as, os.Stdout, time.Second)
+	} else {
+		go outputInfo(as)
+	}
+
+	if MetricsAddr != "" {
+		go func() {
+			if err := basic.ServeMetrics(MetricsAddr); err != nil {
+				fmt.Printf("Failed to serve metrics: %s\n", err)
+			}
+		}()
+	}
+
+	if ControlAddr != "" {
+		go func() {
+			if err := serveControl(ControlAddr, as); err != nil {
+				fmt.Printf("Failed to serve control API: %s\n", err)
+			}
+		}()
+	}
 
-	as.Wait()
+	as.Wait(DrainTimeout)
+	cancel() // 不再等待的交易直接放弃，关闭所有连接
+	if dash != nil {
+		dash.Stop()
+	}
+	basic.StopTracing()
+	basic.StopSinks()
+	report := as.Report()
+	if err := report.Save(ReportPath, strings.Split(ReportFormats, ",")); err != nil {
+		fmt.Printf("Failed to write report: %s\n", err)
+	}
+	if report.Client.Saturated() {
+		fmt.Printf("WARNING: the generator was saturated in %d of %d samples (%v), results may be limited by the client rather than Fabric\n",
+			report.Client.SaturatedSamples, report.Client.Samples, report.Client.Reasons)
+	}
 	fmt.Println("quit")
 	os.Exit(0)
 }
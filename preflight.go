@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/hcg1314/stupid/assembler/basic"
+	"github.com/hcg1314/stupid/assembler/infra"
+	"github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/peer"
+)
+
+// preflight 逐项检查并打印结果，记录是否有失败
+type preflight struct {
+	out    io.Writer
+	failed int
+}
+
+func (p *preflight) pass(name, format string, args ...interface{}) {
+	fmt.Fprintf(p.out, "[PASS] %s: %s\n", name, fmt.Sprintf(format, args...))
+}
+
+func (p *preflight) fail(name string, err error) {
+	p.failed++
+	fmt.Fprintf(p.out, "[FAIL] %s: %s\n", name, err)
+}
+
+func (p *preflight) skip(name, reason string) {
+	fmt.Fprintf(p.out, "[SKIP] %s: %s\n", name, reason)
+}
+
+func preflightUsage(fs *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s preflight -path config.json [options]\n\n"+
+			"Check the identity, TLS connections, block delivery and endorsement before a run, exit with 1 if any check fails.\n"+
+			"One real proposal is sent to each peer, it is endorsed but never submitted to the orderer.\n\n",
+			os.Args[0])
+		fs.PrintDefaults()
+	}
+}
+
+// runPreflight 实现preflight子命令，返回进程退出码
+func runPreflight(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("preflight", flag.ContinueOnError)
+	path := fs.String("path", "", "the path of config file")
+	timeout := fs.Duration("timeout", 10*time.Second, "the timeout of each network check")
+	fs.Usage = preflightUsage(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *path == "" || *timeout <= 0 {
+		fs.Usage()
+		return 2
+	}
+
+	p := &preflight{out: out}
+	config, err := basic.LoadConfig(*path)
+	if err != nil {
+		p.fail("config", err)
+		return 1
+	}
+	p.pass("config", "%s, %d peers, channel %s, chaincode %s", *path, len(config.Peers), config.Channel, config.Chaincode)
+
+	identity := p.checkIdentity(config)
+	certs, err := basic.GetTLSCACerts(config.TLSCACerts)
+	if err != nil {
+		p.fail("tls ca certs", err)
+	} else {
+		p.pass("tls ca certs", "%d loaded", len(certs))
+		for _, n := range config.Peers {
+			p.checkTLS("tls peer "+n.Addr, n, certs, *timeout)
+		}
+		p.checkTLS("tls orderer "+config.Orderer.Addr, config.Orderer, certs, *timeout)
+	}
+
+	if !identity || err != nil {
+		p.skip("deliver", "identity or tls ca certs not usable")
+		p.skip("proposal", "identity or tls ca certs not usable")
+	} else if crypto, err := config.LoadCrypto(); err != nil {
+		p.fail("crypto", err)
+	} else if len(config.Peers) == 0 {
+		p.fail("deliver", fmt.Errorf("no peers in config"))
+	} else {
+		p.checkDeliver(config, crypto, *timeout)
+		for _, n := range config.Peers {
+			p.checkProposal(config, n, crypto, *timeout)
+		}
+	}
+
+	if p.failed > 0 {
+		fmt.Fprintf(out, "%d checks failed\n", p.failed)
+		return 1
+	}
+	fmt.Fprintln(out, "all checks passed")
+	return 0
+}
+
+// checkIdentity 私钥和证书能够解析、互相匹配并且证书在有效期内
+func (p *preflight) checkIdentity(config *basic.Config) bool {
+	key, err := basic.GetPrivateKey(config.PrivateKey)
+	if err != nil {
+		p.fail("private key", err)
+	} else {
+		p.pass("private key", "%s, ECDSA %s", config.PrivateKey, key.Curve.Params().Name)
+	}
+
+	cert, _, err := basic.GetCertificate(config.SignCert)
+	if err != nil {
+		p.fail("sign cert", err)
+		return false
+	}
+	now := time.Now()
+	switch {
+	case now.Before(cert.NotBefore):
+		p.fail("sign cert", fmt.Errorf("%s is not valid before %s", cert.Subject, cert.NotBefore.Format(time.RFC3339)))
+		return false
+	case now.After(cert.NotAfter):
+		p.fail("sign cert", fmt.Errorf("%s expired at %s", cert.Subject, cert.NotAfter.Format(time.RFC3339)))
+		return false
+	}
+	p.pass("sign cert", "%s, issued by %s, expires %s", cert.Subject, cert.Issuer, cert.NotAfter.Format(time.RFC3339))
+	if key == nil {
+		return false
+	}
+
+	if !matchKey(cert, key) {
+		p.fail("key pair", fmt.Errorf("private key %s does not match sign cert %s", config.PrivateKey, config.SignCert))
+		return false
+	}
+	p.pass("key pair", "private key matches sign cert")
+	return true
+}
+
+func matchKey(cert *x509.Certificate, key *ecdsa.PrivateKey) bool {
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	return ok && pub.Curve == key.Curve && pub.X.Cmp(key.X) == 0 && pub.Y.Cmp(key.Y) == 0
+}
+
+// checkTLS 用配置的override name完成TLS握手，没有配置CA证书时只检查TCP连接
+func (p *preflight) checkTLS(name string, node basic.Node, certs [][]byte, timeout time.Duration) {
+	dialer := &net.Dialer{Timeout: timeout}
+	start := time.Now()
+	if len(certs) == 0 {
+		conn, err := dialer.Dial("tcp", node.Addr)
+		if err != nil {
+			p.fail(name, err)
+			return
+		}
+		conn.Close()
+		p.pass(name, "no tls ca certs, plain TCP connected in %s", time.Since(start))
+		return
+	}
+
+	pool := x509.NewCertPool()
+	for _, c := range certs {
+		pool.AppendCertsFromPEM(c)
+	}
+	serverName := node.OverrideName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(node.Addr)
+		if err != nil {
+			p.fail(name, err)
+			return
+		}
+		serverName = host
+	}
+	conn, err := tls.DialWithDialer(dialer, "tcp", node.Addr, &tls.Config{RootCAs: pool, ServerName: serverName})
+	if err != nil {
+		p.fail(name, err)
+		return
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	var peerName string
+	if len(state.PeerCertificates) > 0 {
+		peerName = state.PeerCertificates[0].Subject.String()
+	}
+	p.pass(name, "handshake as %s with %s in %s", serverName, peerName, time.Since(start))
+}
+
+// checkDeliver 身份能够在通道上订阅区块，和Observer使用相同的请求
+func (p *preflight) checkDeliver(config *basic.Config, crypto *basic.Crypto, timeout time.Duration) {
+	name := "deliver " + config.Peers[0].Addr
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	d, err := infra.CreateDeliverFilteredClient(ctx, config.Peers[0], crypto.TLSCACerts)
+	if err != nil {
+		p.fail(name, err)
+		return
+	}
+	seek, err := infra.CreateSignedDeliverNewestEnv(config.Channel, crypto)
+	if err != nil {
+		p.fail(name, err)
+		return
+	}
+	if err = d.Send(seek); err != nil {
+		p.fail(name, err)
+		return
+	}
+	r, err := d.Recv()
+	if err != nil {
+		p.fail(name, err)
+		return
+	}
+	switch t := r.Type.(type) {
+	case *peer.DeliverResponse_FilteredBlock:
+		p.pass(name, "channel %s readable, newest block %d", config.Channel, t.FilteredBlock.Number)
+	case *peer.DeliverResponse_Status:
+		if t.Status != common.Status_SUCCESS {
+			p.fail(name, fmt.Errorf("channel %s: %s", config.Channel, t.Status))
+			return
+		}
+		p.pass(name, "channel %s readable", config.Channel)
+	default:
+		p.fail(name, fmt.Errorf("unexpected response %T", r.Type))
+	}
+}
+
+// checkProposal 向peer发送一个真实的提案，只背书不提交
+func (p *preflight) checkProposal(config *basic.Config, node basic.Node, crypto *basic.Crypto, timeout time.Duration) {
+	name := "proposal " + node.Addr
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	key := fmt.Sprintf("preflight-%d", time.Now().UnixNano())
+	prop, _, err := infra.CreateProposal(crypto, config.Channel, config.Chaincode, "addFile", key, key)
+	if err != nil {
+		p.fail(name, err)
+		return
+	}
+	signed, err := infra.SignProposal(prop, crypto)
+	if err != nil {
+		p.fail(name, err)
+		return
+	}
+	e, err := infra.CreateEndorserClient(ctx, node, crypto.TLSCACerts)
+	if err != nil {
+		p.fail(name, err)
+		return
+	}
+	start := time.Now()
+	r, err := e.ProcessProposal(ctx, signed)
+	latency := time.Since(start)
+	if err != nil {
+		p.fail(name, err)
+		return
+	}
+	if r == nil || r.Response == nil {
+		p.fail(name, fmt.Errorf("empty proposal response after %s", latency))
+		return
+	}
+	if r.Response.Status < 200 || r.Response.Status >= 400 {
+		p.fail(name, fmt.Errorf("status %d after %s: %s", r.Response.Status, latency, r.Response.Message))
+		return
+	}
+	p.pass(name, "status %d in %s", r.Response.Status, latency)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hcg1314/stupid/assembler"
+	"github.com/hcg1314/stupid/assembler/basic"
+)
+
+// workerTokenEnv 共享令牌的环境变量，比命令行参数更不容易泄露
+const workerTokenEnv = "STUPID_WORKER_TOKEN"
+
+const (
+	workerIdle    = "idle"
+	workerWaiting = "waiting" // 已连接Fabric，等待统一的开始时间
+	workerRunning = "running"
+	workerDone    = "done"
+)
+
+// workerJob 协调者下发的任务
+type workerJob struct {
+	Config    *basic.Config     `json:"config"`
+	Files     map[string][]byte `json:"files"` // 配置中引用的私钥和证书，key为协调者上的路径
+	Speed     uint              `json:"speed"`
+	Total     uint64            `json:"total"`
+	KeyOffset uint64            `json:"key_offset"`
+	StartAt   time.Time         `json:"start_at"`
+	Drain     time.Duration     `json:"drain"` // 生成结束后等待上链的时间
+}
+
+type workerStatus struct {
+	State  string        `json:"state"`
+	Sample *basic.Sample `json:"sample,omitempty"`
+}
+
+// worker 执行一次压测，报告被取走后进程退出，因为统计都是进程内全局的
+type worker struct {
+	lock      sync.Mutex
+	state     string
+	as        *assembler.Assembler
+	dir       string
+	once      sync.Once
+	collected chan struct{}
+}
+
+func (w *worker) setState(state string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.state = state
+}
+
+// writeFiles 把私钥和证书写到本地临时目录，并改写配置中的路径
+func (w *worker) writeFiles(job *workerJob) error {
+	paths := make(map[string]string, len(job.Files))
+	i := 0
+	for orig, content := range job.Files {
+		p := filepath.Join(w.dir, fmt.Sprintf("%d%s", i, filepath.Ext(orig)))
+		if err := ioutil.WriteFile(p, content, 0600); err != nil {
+			return err
+		}
+		paths[orig] = p
+		i++
+	}
+
+	c := job.Config
+	local := func(orig string) (string, error) {
+		p, ok := paths[orig]
+		if !ok {
+			return "", fmt.Errorf("file %s is not distributed", orig)
+		}
+		return p, nil
+	}
+	var err error
+	if c.PrivateKey, err = local(c.PrivateKey); err != nil {
+		return err
+	}
+	if c.SignCert, err = local(c.SignCert); err != nil {
+		return err
+	}
+	for j := range c.TLSCACerts {
+		if c.TLSCACerts[j], err = local(c.TLSCACerts[j]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *worker) run(job *workerJob) (err error) {
+	w.lock.Lock()
+	if w.state != workerIdle {
+		w.lock.Unlock()
+		return fmt.Errorf("worker is %s, restart it to run again", w.state)
+	}
+	w.state = workerWaiting
+	w.lock.Unlock()
+
+	defer func() {
+		if err != nil {
+			w.setState(workerIdle)
+		}
+	}()
+
+	if err = w.writeFiles(job); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(job.Config)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(w.dir, "config.json")
+	if err = ioutil.WriteFile(path, raw, 0600); err != nil {
+		return err
+	}
+
+	as, err := assembler.CreateAssembler(context.Background(), job.Speed, job.Total, path)
+	if err != nil {
+		return err
+	}
+	as.SetKeyOffset(job.KeyOffset)
+	startPipeline(as)
+	w.lock.Lock()
+	w.as = as
+	w.lock.Unlock()
+
+	fmt.Printf("speed %d, total %d, key offset %d, starting at %s\n", job.Speed, job.Total, job.KeyOffset, job.StartAt.Format(time.RFC3339Nano))
+	go func() {
+		time.Sleep(time.Until(job.StartAt))
+		w.setState(workerRunning)
+		go as.Start()
+		as.Wait(job.Drain)
+		as.Close()
+		basic.StopTracing()
+		basic.StopSinks()
+		w.setState(workerDone)
+		fmt.Println("run finished, waiting for the coordinator to collect the report")
+	}()
+	return nil
+}
+
+func (w *worker) handleRun(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	job := &workerJob{}
+	if err := json.NewDecoder(r.Body).Decode(job); err != nil || job.Config == nil {
+		http.Error(rw, fmt.Sprintf("invalid job: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := w.run(job); err != nil {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (w *worker) handleStatus(rw http.ResponseWriter, _ *http.Request) {
+	w.lock.Lock()
+	status := workerStatus{State: w.state}
+	as := w.as
+	w.lock.Unlock()
+	if as != nil {
+		status.Sample = as.Sample()
+	}
+	writeJSON(rw, status)
+}
+
+func (w *worker) stop() {
+	w.lock.Lock()
+	as := w.as
+	w.lock.Unlock()
+	if as != nil {
+		as.Stop()
+	}
+}
+
+func (w *worker) handleStop(rw http.ResponseWriter, _ *http.Request) {
+	w.stop()
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (w *worker) handleReport(rw http.ResponseWriter, _ *http.Request) {
+	w.lock.Lock()
+	state, as := w.state, w.as
+	w.lock.Unlock()
+	if state != workerDone {
+		http.Error(rw, "run is "+state, http.StatusConflict)
+		return
+	}
+	writeJSON(rw, basic.WorkerResult{Report: as.Report(), Histograms: as.GetHistograms()})
+	w.once.Do(func() { close(w.collected) })
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		fmt.Printf("Failed to write response: %s\n", err)
+	}
+}
+
+// authorize 检查协调者带来的共享令牌，任务中有私钥，不能接受任何人的请求
+func authorize(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(rw, "invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// runWorker 实现worker子命令，等待协调者下发任务，返回进程退出码
+func runWorker(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("worker", flag.ContinueOnError)
+	listen := fs.String("listen", "127.0.0.1:7070", "the address to accept jobs from the coordinator on")
+	token := fs.String("token", os.Getenv(workerTokenEnv), "the shared token the coordinator must present, defaults to $"+workerTokenEnv)
+	certFile := fs.String("tls-cert", "", "the TLS certificate to serve with, plain HTTP if empty")
+	keyFile := fs.String("tls-key", "", "the private key of -tls-cert")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if strings.TrimSpace(*token) == "" || (*certFile == "") != (*keyFile == "") {
+		fmt.Fprintf(out, "-token or $%s is required, -tls-cert and -tls-key must be given together\n", workerTokenEnv)
+		fs.PrintDefaults()
+		return 2
+	}
+
+	dir, err := ioutil.TempDir("", "stupid-worker")
+	if err != nil {
+		fmt.Fprintf(out, "Failed to create temp dir: %s\n", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	w := &worker{state: workerIdle, dir: dir, collected: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/run", w.handleRun)
+	mux.HandleFunc("/status", w.handleStatus)
+	mux.HandleFunc("/stop", w.handleStop)
+	mux.HandleFunc("/report", w.handleReport)
+	mux.Handle("/metrics", basic.GlobalMetrics)
+	server := &http.Server{Addr: *listen, Handler: authorize(*token, mux)}
+
+	errs := make(chan error, 1)
+	go func() {
+		if *certFile != "" {
+			errs <- server.ListenAndServeTLS(*certFile, *keyFile)
+			return
+		}
+		errs <- server.ListenAndServe()
+	}()
+	if *certFile == "" {
+		fmt.Fprintf(out, "worker listening on %s without TLS, keys are sent in clear text\n", *listen)
+	} else {
+		fmt.Fprintf(out, "worker listening on %s with TLS\n", *listen)
+	}
+	go userCtrl(w.stop)
+
+	select {
+	case err = <-errs:
+		fmt.Fprintf(out, "Failed to serve: %s\n", err)
+		return 1
+	case <-w.collected:
+	}
+	// 等报告的响应写完再退出
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_ = server.Shutdown(ctx)
+	fmt.Fprintln(out, "report collected, quit")
+	return 0
+}